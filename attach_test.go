@@ -0,0 +1,579 @@
+package dockerpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// lineRecorder collects the stderr lines of a Client.
+type lineRecorder struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (r *lineRecorder) add(line string) {
+	r.mutex.Lock()
+	r.lines = append(r.lines, line)
+	r.mutex.Unlock()
+}
+
+func (r *lineRecorder) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+func TestAttachKeepsBufferedFrames(t *testing.T) {
+	// frames that arrive with the attach response end up buffered by the
+	// hijack, rather than on the connection.
+	var prefix bytes.Buffer
+	writeFrame(&prefix, STDERR, []byte("starting\n"))
+	writeFrame(&prefix, STDERR, []byte("ready\n"))
+
+	daemon := newTestDaemon(t)
+	daemon.prefix = prefix.Bytes()
+	var lines lineRecorder
+	d := newAttachedClient(t, daemon, func(d *Client) {
+		d.SetStdErrLineHandler(lines.add)
+	})
+
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	got := lines.get()
+	want := []string{"starting", "ready", "echo: hi"}
+	if len(got) != len(want) {
+		t.Fatalf("got stderr lines %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got stderr lines %q, want %q", got, want)
+		}
+	}
+}
+
+func TestProbeKeepsEarlyOutput(t *testing.T) {
+	// the plugin writes as soon as it is attached, before the probe.
+	var prefix bytes.Buffer
+	writeFrame(&prefix, STDERR, []byte("ready\n"))
+
+	daemon := newTestDaemon(t)
+	daemon.prefix = prefix.Bytes()
+	var lines lineRecorder
+	d := attachedClient(t, daemon, func(d *Client) {
+		d.SetStdErrLineHandler(lines.add)
+	})
+
+	if err := d.probe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	if got := lines.get(); len(got) != 2 || got[0] != "ready" {
+		t.Fatalf("got stderr lines %q, want the early line first", got)
+	}
+}
+
+func TestProbeBrokenConn(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.hangup = true
+	d := attachedClient(t, daemon, nil)
+
+	if err := d.probe(); err == nil {
+		t.Fatal("probe of a closed attach connection succeeded")
+	}
+}
+
+func TestAttachHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    map[string]string // "" for absent
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"Content-Type": "text/plain", "Connection": "Upgrade", "Upgrade": "tcp"},
+		},
+		{
+			name:    "override",
+			headers: http.Header{"Content-Type": {"application/octet-stream"}, "X-Proxy": {"1"}},
+			want:    map[string]string{"Content-Type": "application/octet-stream", "Connection": "Upgrade", "Upgrade": "tcp", "X-Proxy": "1"},
+		},
+		{
+			name:    "remove",
+			headers: http.Header{"Content-Type": nil},
+			want:    map[string]string{"Content-Type": "", "Connection": "Upgrade", "Upgrade": "tcp"},
+		},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		attachedClient(t, daemon, func(d *Client) {
+			d.AttachHeaders = test.headers
+		})
+
+		req := daemon.lastRequest()
+		if req.Method != "POST" || req.URL.Path != "/containers/plugin/attach" {
+			t.Errorf("%s: attached with %s %s", test.name, req.Method, req.URL.Path)
+		}
+		for key, want := range test.want {
+			if got := req.Header.Get(key); got != want {
+				t.Errorf("%s: header %s = %q, want %q", test.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestAttachStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		stderr  bool
+		capture bool // CaptureStderr
+		query   string
+		want    string // StdError after the call
+	}{
+		{"all", true, true, "stderr=1&stdin=1&stdout=1&stream=1", "echo: hi\n"},
+		{"no stderr", false, true, "stdin=1&stdout=1&stream=1", ""},
+		{"no capture", true, false, "stderr=1&stdin=1&stdout=1&stream=1", ""},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		var lines lineRecorder
+		d := newAttachedClient(t, daemon, func(d *Client) {
+			d.attachOpts.Stderr = test.stderr
+			d.CaptureStderr = test.capture
+			d.SetStdErrLineHandler(lines.add)
+		})
+
+		if got := daemon.lastRequest().URL.RawQuery; got != test.query {
+			t.Errorf("%s: attached with %q, want %q", test.name, got, test.query)
+		}
+		var reply string
+		if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+			t.Fatalf("%s: got %q, %v", test.name, reply, err)
+		}
+		if got := d.StdError(); got != test.want {
+			t.Errorf("%s: StdError = %q, want %q", test.name, got, test.want)
+		}
+		if got := lines.get(); (len(got) > 0) != (test.want != "") {
+			t.Errorf("%s: got stderr lines %q", test.name, got)
+		}
+	}
+}
+
+func TestAttachDialContext(t *testing.T) {
+	daemon := newTestDaemon(t)
+
+	var network, addr string
+	d := newAttachedClient(t, daemon, func(d *Client) {
+		d.DialContext = func(ctx context.Context, n, a string) (net.Conn, error) {
+			network, addr = n, a
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, n, a)
+		}
+	})
+
+	if network != "tcp" || addr != daemon.listener.Addr().String() {
+		t.Errorf("dialed %s %s, want tcp %s", network, addr, daemon.listener.Addr())
+	}
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+}
+
+func TestAttachDialContextError(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := NewClient("", "plugin", daemon.endpoint())
+	d.ID = "plugin"
+	d.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("no route")
+	}
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.attach(context.Background(), testAttachOptions); err == nil || err.Error() != "no route" {
+		t.Errorf("attach = %v, want the dial error", err)
+	}
+}
+
+func TestSplitAttach(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := newAttachedClient(t, daemon, func(d *Client) {
+		d.SplitAttach = true
+	})
+
+	daemon.mutex.Lock()
+	var queries []string
+	for _, req := range daemon.requests {
+		queries = append(queries, req.URL.RawQuery)
+	}
+	daemon.mutex.Unlock()
+	want := []string{"stderr=1&stdout=1&stream=1", "stdin=1&stream=1"}
+	if len(queries) != len(want) || queries[0] != want[0] || queries[1] != want[1] {
+		t.Fatalf("attached with %q, want output first, then stdin: %q", queries, want)
+	}
+	if _, ok := d.pipes.conn.(*deadlineConn).Conn.(*splitConn); !ok {
+		t.Fatalf("session runs over a %T", d.pipes.conn.(*deadlineConn).Conn)
+	}
+
+	for _, msg := range []string{"one", "two"} {
+		var reply string
+		if err := d.Call("Echo.Echo", msg, &reply); err != nil || reply != msg {
+			t.Fatalf("got %q, %v", reply, err)
+		}
+	}
+	if got := d.StdError(); got != "echo: two\n" {
+		t.Errorf("StdError = %q", got)
+	}
+}
+
+func TestAttachStreamingContainerContext(t *testing.T) {
+	// a daemon that accepts the attach, but never answers it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := NewClient("", "plugin", "tcp://"+l.Addr().String())
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ctx func() (context.Context, context.CancelFunc)
+		err error
+	}{
+		{func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		ctx, cancel := test.ctx()
+		start := time.Now()
+		err := d.AttachStreamingContainerContext(ctx, testAttachOptions)
+		cancel()
+		if err != test.err {
+			t.Errorf("attach = %v, want %v", err, test.err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("attach took %s to give up", elapsed)
+		}
+	}
+}
+
+func TestAttachStreamingContainer(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := NewClient("", "plugin", daemon.endpoint())
+	d.RemoveOnClose = false
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.AttachStreamingContainer(testAttachOptions); err != nil {
+		t.Fatal(err)
+	}
+	if d.clientConn == nil {
+		t.Fatal("no connection after the attach")
+	}
+}
+
+func TestStartExitedContainer(t *testing.T) {
+	// the entrypoint does not read stdin, and is gone before the attach.
+	daemon := newTestDaemon(t)
+	daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		c := testContainer()
+		c.State = docker.State{Status: "exited", ExitCode: 3}
+		writeJSON(w, 200, c)
+	})
+	daemon.route("GET /containers/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stderr") != "1" {
+			t.Errorf("read the logs with %s", r.URL.RawQuery)
+		}
+		w.WriteHeader(200)
+		writeFrame(w, STDOUT, []byte("usage: plugin [flags]\n"))
+		writeFrame(w, STDERR, []byte("plugin: missing -config\n"))
+	})
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+
+	err := d.Start()
+	want := "container plugin exited right after start with code 3 (does the entrypoint keep reading stdin?): plugin: missing -config"
+	if err == nil || err.Error() != want {
+		t.Errorf("Start = %v, want %s", err, want)
+	}
+	if reqs := daemon.requestsTo("POST", "/containers/plugin/attach"); len(reqs) != 0 {
+		t.Error("attached to the exited container")
+	}
+}
+
+func TestStartContextResult(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+
+	result, err := d.StartContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StartResult{ID: "plugin", Name: "plugin", Image: "image", Endpoint: daemon.endpoint()}
+	if *result != want {
+		t.Errorf("StartContext = %+v, want %+v", *result, want)
+	}
+	if d.ID != result.ID {
+		t.Errorf("ID is %q, the result's %q", d.ID, result.ID)
+	}
+}
+
+func TestStartLogging(t *testing.T) {
+	var output bytes.Buffer
+	writeFrame(&output, STDOUT, []byte("hello\n"))
+	writeFrame(&output, STDERR, []byte("warning: no config\n"))
+	writeFrame(&output, STDOUT, []byte("bye\n"))
+	daemon := newTestDaemon(t)
+	daemon.prefix = output.Bytes()
+	daemon.hangup = true // the container exits after its output.
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := d.StartLogging(context.Background(), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "hello\nbye\n" || stderr.String() != "warning: no config\n" {
+		t.Errorf("got stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+	if d.rpcClient != nil {
+		t.Error("StartLogging started an RPC session")
+	}
+
+	// a container that keeps running streams until the context is done.
+	daemon = newTestDaemon(t)
+	d = NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.StartLogging(ctx, nil, nil); err != context.DeadlineExceeded {
+		t.Errorf("StartLogging = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStartWithOptions(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := NewClient("", "image", daemon.endpoint())
+	d.setEnv("IGNORED", "1")
+	defer d.Close()
+
+	opts := docker.CreateContainerOptions{
+		Name:       "custom",
+		Config:     &docker.Config{Image: "custom:v2", Env: []string{"MODE=full"}, Labels: map[string]string{"team": "x"}},
+		HostConfig: &docker.HostConfig{Memory: 64 << 20, NetworkMode: "none"},
+	}
+	if _, err := d.StartWithOptions(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Config.OpenStdin {
+		t.Error("StartWithOptions changed the caller's config")
+	}
+
+	create := daemon.requestsTo("POST", "/containers/create")[0]
+	if name := create.URL.Query().Get("name"); name != "custom" {
+		t.Errorf("created the container named %q", name)
+	}
+	var body struct {
+		docker.Config
+		HostConfig docker.HostConfig
+	}
+	json.NewDecoder(create.Body).Decode(&body)
+	want := *opts.Config
+	want.OpenStdin = true
+	if !reflect.DeepEqual(body.Config, want) {
+		t.Errorf("created the container with %+v, want %+v", body.Config, want)
+	}
+	if body.HostConfig.Memory != 64<<20 || body.HostConfig.NetworkMode != "none" {
+		t.Errorf("created the container with %+v", body.HostConfig)
+	}
+	if d.ID != "plugin" {
+		t.Errorf("ID is %q", d.ID)
+	}
+}
+
+func TestStreamStdin(t *testing.T) {
+	// a REPL that answers each line, until its stdin ends.
+	daemon := newTestDaemon(t)
+	daemon.process = func(stdin io.Reader, stdout io.Writer) {
+		lines := bufio.NewScanner(stdin)
+		for lines.Scan() {
+			fmt.Fprintf(stdout, "> %s\n", strings.ToUpper(lines.Text()))
+		}
+	}
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+	if err := d.StreamStdin(strings.NewReader("one\ntwo\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.StartLogging(ctx, &stdout, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "> ONE\n> TWO\n" {
+		t.Errorf("got output %q", got)
+	}
+
+	if err := d.Start(); err != errStdinStreamed {
+		t.Errorf("Start with a stdin stream = %v, want %v", err, errStdinStreamed)
+	}
+	if err := d.StreamStdin(strings.NewReader("")); err == nil {
+		t.Error("StreamStdin after the start succeeded")
+	}
+}
+
+func TestStartChecksAPIVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		err     string
+	}{
+		{"1.41", ""},
+		{"1.24", ""},
+		{"", ""},
+		{"1.23", "docker API version 1.23 is too old for dockerpc, need 1.24 or later; please upgrade the docker daemon"},
+		{"1.12", "docker API version 1.12 is too old for dockerpc, need 1.24 or later; please upgrade the docker daemon"},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		daemon.route("GET /version", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, map[string]string{"ApiVersion": test.version})
+		})
+		d := NewClient("", "image", daemon.endpoint())
+		err := d.Start()
+		d.Close()
+
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("version %q: Start = %v", test.version, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("version %q: Start = %v, want %s", test.version, err, test.err)
+		}
+		if reqs := daemon.requestsTo("POST", "/containers/create"); len(reqs) != 0 {
+			t.Errorf("version %q: created a container on the old daemon", test.version)
+		}
+	}
+}
+
+func TestStartVersionFails(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.route("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		io.WriteString(w, "daemon is restarting")
+	})
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+
+	if err := d.Start(); err == nil || !strings.Contains(err.Error(), "daemon is restarting") {
+		t.Errorf("Start = %v, want the version error", err)
+	}
+	if reqs := daemon.requestsTo("POST", "/containers/create"); len(reqs) != 0 {
+		t.Error("created a container without a version")
+	}
+}
+
+func TestAttachRetries(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.refuse = 1
+	began := time.Now()
+	d := startedClient(t, daemon, func(d *Client) {
+		d.PostStartDelay = 50 * time.Millisecond
+		d.AttachRetries = 2
+	})
+	if elapsed := time.Since(began); elapsed < 50*time.Millisecond {
+		t.Errorf("attached %v after the start, before PostStartDelay", elapsed)
+	}
+	if reqs := daemon.requestsTo("POST", "/containers/plugin/attach"); len(reqs) != 2 {
+		t.Errorf("attached %d times, want a retry after the refused attach", len(reqs))
+	}
+	var reply string
+	if err := d.Call("Echo.Echo", "second", &reply); err != nil || reply != "second" {
+		t.Errorf("got %q, %v over the retried attach", reply, err)
+	}
+}
+
+func TestAttachRetriesRunOut(t *testing.T) {
+	for _, retries := range []int{0, 2} {
+		daemon := newTestDaemon(t)
+		daemon.refuse = retries + 1
+		d := NewClient("", "image", daemon.endpoint())
+		d.AttachRetries = retries
+		err := d.Start()
+		d.Close()
+
+		if err == nil || !strings.Contains(err.Error(), "is not running") {
+			t.Errorf("%d retries: Start = %v, want the refused attach", retries, err)
+		}
+		if reqs := daemon.requestsTo("POST", "/containers/plugin/attach"); len(reqs) != retries+1 {
+			t.Errorf("%d retries: attached %d times", retries, len(reqs))
+		}
+	}
+}
+
+func TestTTYDetected(t *testing.T) {
+	for _, tty := range []bool{true, false} {
+		daemon := newTestDaemon(t)
+		daemon.tty = tty
+		daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+			c := testContainer()
+			c.Config.Tty = tty
+			writeJSON(w, 200, c)
+		})
+		d := startedClient(t, daemon, nil)
+
+		if d.IsTTY() != tty {
+			t.Errorf("IsTTY = %v for a container with Tty %v", d.IsTTY(), tty)
+		}
+		var reply string
+		if err := d.Call("Echo.Echo", "raw?", &reply); err != nil || reply != "raw?" {
+			t.Errorf("tty %v: got %q, %v", tty, reply, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package dockerpc
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCallT(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	tests := []struct {
+		req  testPair
+		want testPair
+	}{
+		{testPair{"a", 1}, testPair{"a", -1}},
+		{testPair{"", 0}, testPair{"", 0}},
+		{testPair{"b", -7}, testPair{"b", 7}},
+	}
+	for _, test := range tests {
+		got, err := CallT[testPair, testPair](d, "Echo.Swap", test.req)
+		if err != nil || got != test.want {
+			t.Errorf("CallT(%v) = %v, %v; want %v", test.req, got, err, test.want)
+		}
+	}
+
+	if got, err := CallT[string, string](d, "Echo.Fail", "boom"); err != rpc.ServerError("boom") || got != "" {
+		t.Errorf("failing CallT = %q, %v", got, err)
+	}
+}
+
+func TestCallBatch(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	var echo, fail string
+	var swap testPair
+	calls := []BatchCall{
+		{Method: "Echo.Echo", Args: "one", Reply: &echo},
+		{Method: "Echo.Fail", Args: "boom", Reply: &fail},
+		{Method: "Echo.Swap", Args: testPair{"k", 2}, Reply: &swap},
+		{Method: "Echo.Missing", Args: "x", Reply: &fail},
+	}
+	if err := d.CallBatch(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+
+	if echo != "one" || calls[0].Error != nil {
+		t.Errorf("Echo.Echo = %q, %v", echo, calls[0].Error)
+	}
+	if calls[1].Error != rpc.ServerError("boom") {
+		t.Errorf("Echo.Fail = %v", calls[1].Error)
+	}
+	if swap != (testPair{"k", -2}) || calls[2].Error != nil {
+		t.Errorf("Echo.Swap = %v, %v", swap, calls[2].Error)
+	}
+	if calls[3].Error == nil {
+		t.Error("Echo.Missing succeeded")
+	}
+	if err := d.CallBatch(context.Background(), nil); err != nil {
+		t.Errorf("empty batch = %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	if in, out := (&Client{}).Stats(); in != 0 || out != 0 {
+		t.Errorf("Stats before Start = %d, %d", in, out)
+	}
+
+	d := newTestClient(t, nil)
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	request := `{"method":"Echo.Echo","params":["hi"],"id":1}` + "\n"
+	response := `{"id":1,"result":"hi","error":null}` + "\n"
+	stderr := "echo: hi\n"
+	in, out := d.Stats()
+	if out != uint64(len(request)) {
+		t.Errorf("bytesOut = %d, want %d", out, len(request))
+	}
+	if in != uint64(len(response)+len(stderr)) {
+		t.Errorf("bytesIn = %d, want %d", in, len(response)+len(stderr))
+	}
+}
+
+func TestCallRaw(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	tests := []struct {
+		method string
+		args   interface{}
+		want   string
+		err    error
+	}{
+		{"Echo.Echo", "hi", `"hi"`, nil},
+		{"Echo.Swap", testPair{"k", 2}, `{"Key":"k","Value":-2}`, nil},
+		{"Echo.Fail", "boom", "", rpc.ServerError("boom")},
+	}
+	for _, test := range tests {
+		got, err := d.CallRaw(context.Background(), test.method, test.args)
+		if string(got) != test.want || err != test.err {
+			t.Errorf("CallRaw(%s) = %s, %v; want %s, %v", test.method, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestCallJSON(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	// a gateway forwarding JSON requests to the plugin.
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params, _ := io.ReadAll(r.Body)
+		result, err := d.CallJSON(r.Context(), r.URL.Query().Get("method"), string(params))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, result)
+	}))
+	defer gateway.Close()
+
+	tests := []struct {
+		method string
+		params string
+		status int
+		want   string
+	}{
+		{"Echo.Echo", `"hi"`, 200, `"hi"`},
+		{"Echo.Swap", `{"Key": "k", "Value": 2}`, 200, `{"Key":"k","Value":-2}`},
+		{"Echo.Echo", `"unterminated`, 502, "not valid JSON\n"},
+		{"Echo.Fail", `"boom"`, 502, "boom\n"},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(gateway.URL+"?method="+test.method, "application/json", strings.NewReader(test.params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || !strings.HasSuffix(string(body), test.want) {
+			t.Errorf("%s(%s) = %d %q, want %d %q", test.method, test.params, resp.StatusCode, body, test.status, test.want)
+		}
+	}
+}
+
+func TestMethodTimeouts(t *testing.T) {
+	d := newTestClient(t, func(d *Client) {
+		d.MethodTimeouts = map[string]time.Duration{"Echo.Sleep": 20 * time.Millisecond}
+	})
+
+	long, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		sleep time.Duration
+		err   error
+	}{
+		{"within the timeout", context.Background(), 0, nil},
+		{"past the timeout", context.Background(), time.Second, context.DeadlineExceeded},
+		{"context deadline wins", long, 50 * time.Millisecond, nil},
+	}
+	for _, test := range tests {
+		var reply time.Duration
+		if err := d.CallContext(test.ctx, "Echo.Sleep", test.sleep, &reply); err != test.err {
+			t.Errorf("%s: CallContext = %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	var reply time.Duration
+	if err := d.Call("Echo.Sleep", time.Second, &reply); err != context.DeadlineExceeded {
+		t.Errorf("Call past the timeout = %v", err)
+	}
+	var echo string
+	if err := d.Call("Echo.Echo", "not bounded", &echo); err != nil {
+		t.Errorf("Call to another method = %v", err)
+	}
+}
+
+func TestMaxConcurrentCalls(t *testing.T) {
+	d := newTestClient(t, func(d *Client) {
+		d.MaxConcurrentCalls = 2
+	})
+
+	// five 100ms calls, two at a time, take at least three rounds.
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply time.Duration
+			errs <- d.Call("Echo.Sleep", 100*time.Millisecond, &reply)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("5 calls limited to 2 at a time took %s", elapsed)
+	}
+	if n := len(d.callSlots); n != 0 {
+		t.Errorf("%d slots still held after the calls", n)
+	}
+}
+
+func TestMaxConcurrentCallsCancel(t *testing.T) {
+	d := newTestClient(t, func(d *Client) {
+		d.MaxConcurrentCalls = 1
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		var reply time.Duration
+		done <- d.Call("Echo.Sleep", 200*time.Millisecond, &reply)
+	}()
+	for len(d.callSlots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// waiting for a slot gives up with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var reply string
+	if err := d.CallContext(ctx, "Echo.Echo", "queued", &reply); err != context.DeadlineExceeded {
+		t.Errorf("waiting call = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Call("Echo.Echo", "next", &reply); err != nil || reply != "next" {
+		t.Errorf("call after the slot freed = %q, %v", reply, err)
+	}
+}
+
+func TestDrainStderr(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	var reply string
+	if err := d.Call("Echo.Echo", "one", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.DrainStderr(); got != "echo: one\n" {
+		t.Errorf("first drain = %q", got)
+	}
+	if got := d.DrainStderr(); got != "" {
+		t.Errorf("second drain = %q, want nothing", got)
+	}
+	if got := d.StdError(); got != "" {
+		t.Errorf("StdError after the drain = %q", got)
+	}
+}
+
+func TestCallAndLog(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	tests := []struct {
+		method string
+		args   string
+		stderr string
+		err    error
+	}{
+		{"Echo.Echo", "one", "echo: one\n", nil},
+		{"Echo.Echo", "two", "echo: two\n", nil},
+		{"Echo.Fail", "boom", "", rpc.ServerError("boom")},
+	}
+	for _, test := range tests {
+		var reply string
+		stderr, err := d.CallAndLog(context.Background(), test.method, test.args, &reply)
+		if stderr != test.stderr || err != test.err {
+			t.Errorf("CallAndLog(%s, %q) = %q, %v; want %q, %v", test.method, test.args, stderr, err, test.stderr, test.err)
+		}
+	}
+}
+
+func TestMethodFormatter(t *testing.T) {
+	// the plugin's methods, under the names the caller uses.
+	names := map[string]string{"echo": "Echo.Echo", "count": "Echo.Count"}
+	d := newTestClient(t, func(d *Client) {
+		d.MethodFormatter = func(method string) string { return names[method] }
+	})
+
+	var reply string
+	if err := d.Call("echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Errorf("Call = %q, %v", reply, err)
+	}
+
+	calls := []BatchCall{{Method: "echo", Args: "batched", Reply: &reply}}
+	if err := d.CallBatch(context.Background(), calls); err != nil || calls[0].Error != nil || reply != "batched" {
+		t.Errorf("CallBatch = %q, %v, %v", reply, err, calls[0].Error)
+	}
+
+	stream, err := d.CallStream(context.Background(), "count", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range stream.C {
+		n++
+	}
+	if n != 2 || stream.Err() != nil {
+		t.Errorf("CallStream sent %d values, ended with %v", n, stream.Err())
+	}
+}
+
+func TestReset(t *testing.T) {
+	d := newTestClient(t, func(d *Client) {
+		d.MethodTimeouts = map[string]time.Duration{"Echo.Sleep": time.Second}
+	})
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Closed() || d.ID != "" || d.StdError() != "" {
+		t.Errorf("after Reset: closed %v, ID %q, stderr %q", d.Closed(), d.ID, d.StdError())
+	}
+	if err := d.Call("Echo.Echo", "again", &reply); err != errNotStarted {
+		t.Errorf("Call after Reset = %v, want %v", err, errNotStarted)
+	}
+	if d.MethodTimeouts["Echo.Sleep"] != time.Second {
+		t.Error("Reset dropped the configuration")
+	}
+}
@@ -0,0 +1,110 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+//
+// Checkpoint saves the state of the plugin container, warmed up caches and
+// all, as the checkpoint `name`, with CRIU, and stops the container; the
+// RPC session ends with it. StartFromCheckpoint resumes the container from
+// the checkpoint, which is quicker than a cold start for plugins with an
+// expensive warmup.
+//
+// Checkpoints need a daemon with experimental features enabled and CRIU
+// installed on its host. The docker client has no checkpoint API, so these
+// requests are sent to the daemon directly, with its HTTP client (see
+// HTTPClient).
+//
+func (d *Client) Checkpoint(ctx context.Context, name string) error {
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+	body := struct {
+		CheckpointID string
+		Exit         bool
+	}{name, true}
+	return d.apiRequest(ctx, "/containers/"+d.ID+"/checkpoints", nil, body, http.StatusCreated)
+}
+
+//
+// StartFromCheckpoint starts the container, stopped by Checkpoint, from the
+// checkpoint `name`, and attaches a new RPC session to it as Reconnect
+// does. See Checkpoint for what the daemon needs.
+//
+func (d *Client) StartFromCheckpoint(ctx context.Context, name string) error {
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+	query := url.Values{"checkpoint": {name}}
+	if err := d.apiRequest(ctx, "/containers/"+d.ID+"/start", query, nil, http.StatusNoContent); err != nil {
+		return err
+	}
+	return d.Reconnect(ctx)
+}
+
+//
+// apiRequest POSTs `body`, as JSON unless nil, to the docker API `path`,
+// and fails unless the daemon answers with status `want`.
+//
+func (d *Client) apiRequest(ctx context.Context, path string, query url.Values, body interface{}, want int) error {
+	network, addr, err := parseEndpoint(d.endpoint)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := url.URL{Scheme: "http", Host: addr, Path: path, RawQuery: query.Encode()}
+	client := d.dockerClient.HTTPClient
+	switch {
+	case network != "tcp":
+		// as with the docker client, whose own transport reaches sockets and
+		// pipes; the host is then only for the request line.
+		u.Host = "docker"
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.dial(ctx, network, addr)
+			},
+		}}
+		defer client.CloseIdleConnections()
+	case d.dockerClient.TLSConfig != nil:
+		u.Scheme = "https"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		var msg struct{ Message string }
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &msg) != nil || msg.Message == "" {
+			msg.Message = string(bytes.TrimSpace(b))
+		}
+		return fmt.Errorf("dockerpc: POST %s: %s: %s", path, resp.Status, msg.Message)
+	}
+	return nil
+}
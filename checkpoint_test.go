@@ -0,0 +1,94 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := newAttachedClient(t, daemon, nil)
+
+	if err := d.Checkpoint(context.Background(), "warm"); err != nil {
+		t.Fatal(err)
+	}
+	req := daemon.lastRequest()
+	if req.Method != "POST" || req.URL.Path != "/containers/plugin/checkpoints" {
+		t.Errorf("checkpointed with %s %s", req.Method, req.URL.Path)
+	}
+	var body struct {
+		CheckpointID string
+		Exit         bool
+	}
+	b, _ := io.ReadAll(req.Body)
+	if err := json.Unmarshal(b, &body); err != nil || body.CheckpointID != "warm" || !body.Exit {
+		t.Errorf("checkpointed with %s", b)
+	}
+
+	if err := d.StartFromCheckpoint(context.Background(), "warm"); err != nil {
+		t.Fatal(err)
+	}
+	daemon.mutex.Lock()
+	start := daemon.requests[len(daemon.requests)-2]
+	daemon.mutex.Unlock()
+	if start.URL.Path != "/containers/plugin/start" || start.URL.Query().Get("checkpoint") != "warm" {
+		t.Errorf("started with %s %s", start.Method, start.URL)
+	}
+	if got := daemon.lastRequest().URL.Path; got != "/containers/plugin/attach" {
+		t.Errorf("reattached with %s", got)
+	}
+	var reply string
+	if err := d.Call("Echo.Echo", "restored", &reply); err != nil || reply != "restored" {
+		t.Errorf("Call after the restore = %q, %v", reply, err)
+	}
+}
+
+// recordingTransport keeps the paths of the requests it sends on.
+type recordingTransport struct {
+	mutex sync.Mutex
+	paths []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mutex.Lock()
+	rt.paths = append(rt.paths, req.URL.Path)
+	rt.mutex.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCheckpointUsesHTTPClient(t *testing.T) {
+	daemon := newTestDaemon(t)
+	transport := &recordingTransport{}
+	d := attachedClient(t, daemon, func(d *Client) {
+		d.HTTPClient = &http.Client{Transport: transport}
+	})
+
+	if err := d.Checkpoint(context.Background(), "warm"); err != nil {
+		t.Fatal(err)
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if len(transport.paths) == 0 || transport.paths[len(transport.paths)-1] != "/containers/plugin/checkpoints" {
+		t.Errorf("the HTTPClient sent %q", transport.paths)
+	}
+}
+
+func TestCheckpointErrors(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	if err := d.Checkpoint(context.Background(), "warm"); err != errNotStarted {
+		t.Errorf("Checkpoint before Start = %v, want %v", err, errNotStarted)
+	}
+
+	// the test daemon knows no other API call.
+	daemon := newTestDaemon(t)
+	d = attachedClient(t, daemon, nil)
+	err := d.apiRequest(context.Background(), "/containers/plugin/pause", nil, nil, 204)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("apiRequest = %v, want the daemon's 404", err)
+	}
+}
@@ -0,0 +1,117 @@
+package dockerpc
+
+import (
+	"encoding/json"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// Clone returns a new, unstarted Client with the configuration of `d`
+// (image, endpoint, Docker configs, options, handlers and timeouts), for
+// using one Client as a template for a pool. The configuration is deep
+// copied, so changing the clone's env, binds or maps leaves `d` untouched.
+// No runtime state (container, connection, stderr) is carried over.
+//
+// Container names must be unique, so the clone has no name, and Docker
+// generates one when it starts; unless the name was set with SetUniqueName,
+// which the clone keeps.
+//
+func (d *Client) Clone() *Client {
+	c := &Client{
+		dockerImage:  d.dockerImage,
+		endpoint:     d.endpoint,
+		output:       d.output,
+		stdErrLine:   d.stdErrLine,
+		eventHandler: d.eventHandler,
+		wireLog:      d.wireLog,
+		codecFactory: d.codecFactory,
+		platform:     d.platform,
+		imageDigest:  d.imageDigest,
+
+		StopTimeout:        d.StopTimeout,
+		KillOnClose:        d.KillOnClose,
+		CloseMode:          d.CloseMode,
+		PollInterval:       d.PollInterval,
+		PollTimeout:        d.PollTimeout,
+		ReplaceExisting:    d.ReplaceExisting,
+		PinDigest:          d.PinDigest,
+		SessionID:          d.SessionID,
+		Handshake:          d.Handshake,
+		HandshakeTimeout:   d.HandshakeTimeout,
+		ReadyLine:          d.ReadyLine,
+		ReadyTimeout:       d.ReadyTimeout,
+		FatalPattern:       d.FatalPattern,
+		HTTPClient:         d.HTTPClient,
+		CertPath:           d.CertPath,
+		TLSConfig:          d.TLSConfig,
+		ReadTimeout:        d.ReadTimeout,
+		WriteTimeout:       d.WriteTimeout,
+		KeepOnError:        d.KeepOnError,
+		RemoveOnClose:      d.RemoveOnClose,
+		StopOnClose:        d.StopOnClose,
+		DrainOnClose:       d.DrainOnClose,
+		ShutdownMethod:     d.ShutdownMethod,
+		DrainTimeout:       d.DrainTimeout,
+		PostStartDelay:     d.PostStartDelay,
+		AttachRetries:      d.AttachRetries,
+		JSONRPC2:           d.JSONRPC2,
+		MethodFormatter:    d.MethodFormatter,
+		DecodeErrorHandler: d.DecodeErrorHandler,
+		IDGenerator:        d.IDGenerator,
+		MaxConcurrentCalls: d.MaxConcurrentCalls,
+		CallHistorySize:    d.CallHistorySize,
+		DialContext:        d.DialContext,
+		SplitAttach:        d.SplitAttach,
+		AttachHeaders:      d.AttachHeaders.Clone(),
+		LabelEnvPrefix:     d.LabelEnvPrefix,
+		MaxFrameSize:       d.MaxFrameSize,
+		Logger:             d.Logger,
+		CaptureStderr:      d.CaptureStderr,
+	}
+	c.middleware = append([]TransportMiddleware(nil), d.middleware...)
+	for name, data := range d.secrets {
+		c.AddSecret(name, data)
+	}
+
+	if d.uniqueName {
+		// the name is made unique at Start, so it can be shared.
+		c.SetUniqueName(d.name)
+	}
+
+	if d.DockerConfig != nil {
+		c.DockerConfig = &docker.Config{}
+		deepCopy(c.DockerConfig, d.DockerConfig)
+	}
+	if d.DockerHostConfig != nil {
+		c.DockerHostConfig = &docker.HostConfig{}
+		deepCopy(c.DockerHostConfig, d.DockerHostConfig)
+	}
+	if d.DockerAttachOptions != nil {
+		opts := *d.DockerAttachOptions
+		c.DockerAttachOptions = &opts
+	}
+
+	if d.IdempotentMethods != nil {
+		c.IdempotentMethods = make(map[string]bool, len(d.IdempotentMethods))
+		for k, v := range d.IdempotentMethods {
+			c.IdempotentMethods[k] = v
+		}
+	}
+	if d.MethodTimeouts != nil {
+		c.MethodTimeouts = make(map[string]time.Duration, len(d.MethodTimeouts))
+		for k, v := range d.MethodTimeouts {
+			c.MethodTimeouts[k] = v
+		}
+	}
+	return c
+}
+
+// deepCopy copies `src` into `dst` through JSON, so that nothing is shared.
+func deepCopy(dst, src interface{}) {
+	b, err := json.Marshal(src)
+	if err == nil {
+		json.Unmarshal(b, dst)
+	}
+}
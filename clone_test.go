@@ -0,0 +1,89 @@
+package dockerpc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// nonZero returns a value of type `t` that is not the zero value.
+func nonZero(t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Ptr:
+		v.Set(reflect.New(t.Elem()))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(t))
+		v.SetMapIndex(nonZero(t.Key()), nonZero(t.Elem()))
+	case reflect.Slice:
+		v.Set(reflect.Append(v, nonZero(t.Elem())))
+	case reflect.Func:
+		v.Set(reflect.MakeFunc(t, func([]reflect.Value) []reflect.Value {
+			out := make([]reflect.Value, t.NumOut())
+			for i := range out {
+				out[i] = reflect.Zero(t.Out(i))
+			}
+			return out
+		}))
+	case reflect.Interface:
+		// nothing to pick from; the field is skipped.
+	}
+	return v
+}
+
+func TestCloneCopiesConfiguration(t *testing.T) {
+	d := NewClient("plugin", "image", "tcp://docker:2375")
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.IsExported() && field.Name != "ID" {
+			v.Field(i).Set(nonZero(field.Type))
+		}
+	}
+
+	c := reflect.ValueOf(d.Clone()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() || field.Name == "ID" || field.Type.Kind() == reflect.Interface {
+			continue
+		}
+		got, want := c.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Func {
+			if got.IsNil() {
+				t.Errorf("Clone dropped %s", field.Name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got.Interface(), want.Interface()) {
+			t.Errorf("Clone set %s to %v, want %v", field.Name, got, want)
+		}
+	}
+}
+
+func TestCloneIsDeep(t *testing.T) {
+	d := NewClient("plugin", "image", "tcp://docker:2375")
+	d.DockerConfig = &docker.Config{Env: []string{"A=1"}}
+	d.DockerHostConfig = &docker.HostConfig{Binds: []string{"/a:/a"}}
+	d.MethodTimeouts = map[string]time.Duration{"Echo.Sleep": time.Second}
+
+	c := d.Clone()
+	c.DockerConfig.Env[0] = "A=2"
+	c.DockerHostConfig.Binds[0] = "/b:/b"
+	c.MethodTimeouts["Echo.Sleep"] = 0
+
+	if d.DockerConfig.Env[0] != "A=1" || d.DockerHostConfig.Binds[0] != "/a:/a" || d.MethodTimeouts["Echo.Sleep"] != time.Second {
+		t.Error("changing the clone changed the original")
+	}
+	if c.name != "" || c.ID != "" {
+		t.Errorf("clone has name %q, ID %q", c.name, c.ID)
+	}
+}
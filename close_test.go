@@ -0,0 +1,125 @@
+package dockerpc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCloseTeardown(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(d *Client)
+		errored   bool
+		want      closeTeardown
+	}{
+		{"default", nil, false, closeTeardown{remove: true}},
+		{"StopTimeout", func(d *Client) { d.StopTimeout = 5 }, false, closeTeardown{stop: true, remove: true}},
+		{"KillOnClose", func(d *Client) { d.StopTimeout = 5; d.KillOnClose = true }, false, closeTeardown{remove: true}},
+		{"no RemoveOnClose", func(d *Client) { d.RemoveOnClose = false }, false, closeTeardown{}},
+		{"StopOnClose", func(d *Client) { d.RemoveOnClose = false; d.StopOnClose = true }, false, closeTeardown{stop: true}},
+		{"force", func(d *Client) { d.CloseMode = CloseForce; d.StopTimeout = 5 }, false, closeTeardown{remove: true}},
+		{"graceful", func(d *Client) { d.CloseMode = CloseGraceful; d.RemoveOnClose = false }, false, closeTeardown{stop: true, remove: true}},
+		{"detach", func(d *Client) { d.CloseMode = CloseDetach; d.StopTimeout = 5 }, false, closeTeardown{}},
+		{"KeepOnError", func(d *Client) { d.KeepOnError = true; d.CloseMode = CloseForce }, true, closeTeardown{stop: true, kept: true}},
+		{"KeepOnError without errors", func(d *Client) { d.KeepOnError = true; d.CloseMode = CloseForce }, false, closeTeardown{remove: true}},
+		{"KeepOnError, detach", func(d *Client) { d.KeepOnError = true; d.CloseMode = CloseDetach }, true, closeTeardown{}},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "tcp://docker:2375")
+		if test.configure != nil {
+			test.configure(d)
+		}
+		d.errored.Store(test.errored)
+		if got := d.teardown(); got != test.want {
+			t.Errorf("%s: Close would %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCloseModeString(t *testing.T) {
+	tests := map[CloseMode]string{
+		CloseByFields: "by fields",
+		CloseForce:    "force",
+		CloseGraceful: "graceful",
+		CloseDetach:   "detach",
+		CloseMode(9):  "CloseMode(9)",
+	}
+	for mode, want := range tests {
+		if got := mode.String(); got != want {
+			t.Errorf("CloseMode %d is %q, want %q", int(mode), got, want)
+		}
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	daemon := newTestDaemon(t)
+	release := make(chan struct{})
+	defer close(release)
+	// the daemon hangs on the remove.
+	daemon.route("DELETE /containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(204)
+	})
+	d := startedClient(t, daemon, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := d.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("CloseContext = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CloseContext took %s", elapsed)
+	}
+	if len(daemon.requestsTo("DELETE", "/containers/plugin")) != 1 {
+		t.Error("CloseContext did not remove the container")
+	}
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err == nil {
+		t.Error("Call after CloseContext succeeded")
+	}
+}
+
+func TestCloseContextStopTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration // 0 for none
+		want     string        // the stop timeout sent, in seconds
+	}{
+		{"no deadline", 0, "30"},
+		{"deadline", 2500 * time.Millisecond, "1"},
+		{"tight deadline", 500 * time.Millisecond, "0"},
+		{"loose deadline", time.Minute, "30"},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		d := startedClient(t, daemon, func(d *Client) {
+			d.StopTimeout = 30
+		})
+
+		ctx := context.Background()
+		if test.deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.deadline)
+			defer cancel()
+		}
+		if err := d.CloseContext(ctx); err != nil {
+			t.Errorf("%s: CloseContext = %v", test.name, err)
+		}
+
+		stops := daemon.requestsTo("POST", "/containers/plugin/stop")
+		if len(stops) != 1 {
+			t.Errorf("%s: stopped %d times", test.name, len(stops))
+			continue
+		}
+		if got := stops[0].URL.Query().Get("t"); got != test.want {
+			t.Errorf("%s: stopped with a timeout of %s, want %s", test.name, got, test.want)
+		}
+		removes := daemon.requestsTo("DELETE", "/containers/plugin")
+		if len(removes) != 1 || removes[0].URL.Query().Get("force") != "1" {
+			t.Errorf("%s: removed %d times after the stop, want a force remove", test.name, len(removes))
+		}
+	}
+}
@@ -0,0 +1,775 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//
+// clientCodec is a JSON-RPC 1.0 rpc.ClientCodec, wire compatible with
+// net/rpc/jsonrpc, which can also speak JSON-RPC 2.0.
+//
+// Unlike the stdlib codec it hands out its own request ids, so that it can
+// also send requests that bypass net/rpc (such as streaming calls) and route
+// their responses to a responseHandler instead.
+//
+type clientCodec struct {
+	dec *json.Decoder // for reading JSON values
+	enc *json.Encoder // for writing JSON values
+	c   io.ReadWriteCloser
+
+	wmu sync.Mutex // serializes writes to c
+
+	// temporary work space
+	resp clientResponse
+
+	jsonrpc2      bool                         // speak JSON-RPC 2.0 rather than 1.0
+	methodName    func(method string) string   // see Client.MethodFormatter
+	onDecodeError func(err *DecodeError)       // see Client.DecodeErrorHandler
+	newID         func(seq uint64) interface{} // see Client.IDGenerator
+
+	mutex    sync.Mutex                 // protects everything below
+	seq      uint64                     // last request id handed out
+	pending  map[uint64]uint64          // request id -> net/rpc sequence number
+	handlers map[uint64]responseHandler // request id -> out of band handler
+	wireIDs  map[string]uint64          // id on the wire -> request id, with newID
+	wireKeys map[uint64]string          // request id -> id on the wire, with newID
+	stopped  bool                       // the codec was upgraded, and must not read any further
+}
+
+// responseHandler receives responses for a request sent outside of net/rpc.
+// It is called with a non-nil err if the connection fails, and returns true
+// once it expects no further responses.
+type responseHandler func(resp *clientResponse, err error) (done bool)
+
+func newClientCodec(conn io.ReadWriteCloser) *clientCodec {
+	dec := json.NewDecoder(conn)
+	// keep error object codes and data exact, see RPCError.
+	dec.UseNumber()
+	return &clientCodec{
+		dec:      dec,
+		enc:      json.NewEncoder(conn),
+		c:        conn,
+		pending:  make(map[uint64]uint64),
+		handlers: make(map[uint64]responseHandler),
+		wireIDs:  make(map[string]uint64),
+		wireKeys: make(map[uint64]string),
+	}
+}
+
+type clientRequest struct {
+	Version string         `json:"jsonrpc,omitempty"` // "2.0" for JSON-RPC 2.0
+	Method  string         `json:"method"`
+	Params  [1]interface{} `json:"params"`
+	Id      interface{}    `json:"id"`
+}
+
+type clientResponse struct {
+	Id     json.RawMessage  `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  interface{}      `json:"error"`
+	Stream bool             `json:"stream,omitempty"` // more responses follow for this id
+}
+
+func (r *clientResponse) reset() {
+	r.Id = nil
+	r.Result = nil
+	r.Error = nil
+	r.Stream = false
+}
+
+//
+// serverError returns the error carried by a response, if any. JSON-RPC 1.0
+// errors are strings, and a null result is an error too; JSON-RPC 2.0 (`v2`)
+// errors are objects, and a null result is a valid one.
+//
+// Error objects are passed on, through net/rpc's string errors, encoded
+// for remoteError to turn into an *RPCError.
+//
+func (r *clientResponse) serverError(v2 bool) (string, error) {
+	if r.Error == nil && (r.Result != nil || v2) {
+		return "", nil
+	}
+	if obj, ok := r.Error.(map[string]interface{}); ok {
+		if b, err := json.Marshal(obj); err == nil {
+			r.Error = rpcErrorPrefix + string(b)
+		}
+	}
+	x, ok := r.Error.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid error %v", r.Error)
+	}
+	if x == "" {
+		x = "unspecified error"
+	}
+	return x, nil
+}
+
+func (c *clientCodec) nextID() uint64 {
+	c.seq++
+	return c.seq
+}
+
+//
+// wireID returns the id to send request `id` with: `id` itself, or the one
+// newID makes for it, which the responses are then matched by. The caller
+// holds c.mutex.
+//
+func (c *clientCodec) wireID(id uint64) (interface{}, error) {
+	if c.newID == nil {
+		return id, nil
+	}
+	b, err := json.Marshal(c.newID(id))
+	if err != nil {
+		return nil, fmt.Errorf("dockerpc: IDGenerator: %s", err)
+	}
+	key := wireKey(b)
+	if _, inFlight := c.wireIDs[key]; inFlight {
+		return nil, fmt.Errorf("dockerpc: IDGenerator returned id %s, already in flight", b)
+	}
+	c.wireIDs[key] = id
+	c.wireKeys[id] = key
+	return json.RawMessage(b), nil
+}
+
+// responseID returns the request id of a response with `raw` for its id, or
+// 0 if it is not one the codec sent. The caller holds c.mutex.
+func (c *clientCodec) responseID(raw json.RawMessage) uint64 {
+	if c.newID != nil {
+		return c.wireIDs[wireKey(raw)]
+	}
+	var id uint64
+	json.Unmarshal(raw, &id)
+	return id
+}
+
+// dropWireID forgets the id on the wire of request `id`. The caller holds
+// c.mutex.
+func (c *clientCodec) dropWireID(id uint64) {
+	if key, ok := c.wireKeys[id]; ok {
+		delete(c.wireIDs, key)
+		delete(c.wireKeys, id)
+	}
+}
+
+// wireKey returns the map key of an id on the wire, as sent or echoed back.
+func wireKey(raw []byte) string {
+	var b bytes.Buffer
+	if json.Compact(&b, raw) != nil {
+		return string(raw)
+	}
+	return b.String()
+}
+
+// request returns a request for `method` in the codec's JSON-RPC version.
+func (c *clientCodec) request(method string, id interface{}) clientRequest {
+	if c.methodName != nil && !strings.HasPrefix(method, reservedPrefix) {
+		method = c.methodName(method)
+	}
+	req := clientRequest{Method: method, Id: id}
+	if c.jsonrpc2 {
+		req.Version = "2.0"
+	}
+	return req
+}
+
+func (c *clientCodec) write(id uint64, method string, param interface{}) error {
+	c.mutex.Lock()
+	wireID, err := c.wireID(id)
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	req := c.request(method, wireID)
+	req.Params[0] = param
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.enc.Encode(&req); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// flush pushes out what the connection buffered, if it buffers, so that a
+// call does not wait on a request that is still in the buffer. It must be
+// called with wmu held.
+func (c *clientCodec) flush() error {
+	if f, ok := c.c.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
+	c.mutex.Lock()
+	id := c.nextID()
+	c.pending[id] = r.Seq
+	c.mutex.Unlock()
+
+	return c.write(id, r.ServiceMethod, param)
+}
+
+//
+// send writes a request whose responses are delivered to `h` rather than to
+// net/rpc. It returns the request id, which can be passed to forget.
+//
+func (c *clientCodec) send(method string, param interface{}, h responseHandler) (uint64, error) {
+	c.mutex.Lock()
+	id := c.nextID()
+	c.handlers[id] = h
+	c.mutex.Unlock()
+
+	err := c.write(id, method, param)
+	if err != nil {
+		c.forget(id)
+	}
+	return id, err
+}
+
+// forget drops the handlers for `ids`; later responses are discarded.
+func (c *clientCodec) forget(ids ...uint64) {
+	c.mutex.Lock()
+	for _, id := range ids {
+		delete(c.handlers, id)
+		c.dropWireID(id)
+	}
+	c.mutex.Unlock()
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	for {
+		c.resp.reset()
+		if err := c.dec.Decode(&c.resp); err != nil {
+			c.fail(err)
+			return err
+		}
+
+		c.mutex.Lock()
+		id := c.responseID(c.resp.Id)
+		h, isHandled := c.handlers[id]
+		seq, isPending := c.pending[id]
+		if isPending {
+			delete(c.pending, id)
+			c.dropWireID(id)
+		}
+		c.mutex.Unlock()
+
+		if isHandled {
+			if h(&c.resp, nil) {
+				c.forget(id)
+			}
+			if c.upgraded() {
+				return errUpgraded
+			}
+			continue
+		}
+
+		if !isPending {
+			// a late response for a request nobody is waiting on.
+			continue
+		}
+
+		r.ServiceMethod = ""
+		r.Seq = seq
+		x, err := c.resp.serverError(c.jsonrpc2)
+		if err != nil {
+			return err
+		}
+		r.Error = x
+		return nil
+	}
+}
+
+//
+// replyBox wraps the reply of a call made through net/rpc, so that a result
+// that does not fit the reply fails that call alone: net/rpc shuts the
+// whole client down on a ReadResponseBody error.
+//
+type replyBox struct {
+	method string
+	reply  interface{}
+	err    *DecodeError
+}
+
+//
+// boxReply returns the reply to hand net/rpc for a call to `method`: `reply`
+// in a replyBox with the default codec `codec`, or `reply` itself with a
+// CodecFactory's (a nil `codec`).
+//
+func boxReply(codec *clientCodec, method string, reply interface{}) (*replyBox, interface{}) {
+	if codec == nil {
+		return nil, reply
+	}
+	box := &replyBox{method: method, reply: reply}
+	return box, box
+}
+
+// result returns the error of the call once it is done.
+func (b *replyBox) result(err error) error {
+	if err == nil && b != nil && b.err != nil {
+		return b.err
+	}
+	return err
+}
+
+func (c *clientCodec) ReadResponseBody(x interface{}) error {
+	box, boxed := x.(*replyBox)
+	if boxed {
+		x = box.reply
+	}
+	if x == nil || c.resp.Result == nil {
+		return nil
+	}
+	err := json.Unmarshal(*c.resp.Result, x)
+	if err != nil && boxed {
+		box.err = c.decodeError(box.method, *c.resp.Result, x, err)
+		return nil
+	}
+	return err
+}
+
+// decodeError describes `err`, from decoding the result of `method` into
+// `reply`, and passes it to the DecodeErrorHandler.
+func (c *clientCodec) decodeError(method string, result json.RawMessage, reply interface{}, err error) *DecodeError {
+	de := &DecodeError{
+		Method:   method,
+		Response: append(json.RawMessage(nil), result...),
+		Type:     reflect.TypeOf(reply),
+		Err:      err,
+	}
+	if c.onDecodeError != nil {
+		c.onDecodeError(de)
+	}
+	return de
+}
+
+// fail notifies all out of band handlers that the connection is gone.
+func (c *clientCodec) fail(err error) {
+	c.mutex.Lock()
+	handlers := c.handlers
+	c.handlers = make(map[uint64]responseHandler)
+	c.mutex.Unlock()
+
+	for _, h := range handlers {
+		h(nil, err)
+	}
+}
+
+func (c *clientCodec) Close() error {
+	if c.upgraded() {
+		// the connection now belongs to the upgraded codec.
+		return nil
+	}
+	return c.c.Close()
+}
+
+// upgraded reports whether the codec handed the connection to another.
+func (c *clientCodec) upgraded() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopped
+}
+
+// idle reports whether no requests are waiting for a response.
+func (c *clientCodec) idle() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending) == 0 && len(c.handlers) == 0
+}
+
+//
+// upgrade asks the server to switch codecs, and once it agrees, stops
+// reading so that nothing meant for the next codec is consumed. It returns
+// the connection for the next codec to use.
+//
+func (c *clientCodec) upgrade(ctx context.Context) (io.ReadWriteCloser, error) {
+	ack := make(chan error, 1)
+
+	id, err := c.send(upgradeMethod, nil, func(resp *clientResponse, err error) bool {
+		if err == nil {
+			var x string
+			x, err = resp.serverError(c.jsonrpc2)
+			if err == nil && x != "" {
+				err = remoteError(x)
+			}
+		}
+		// runs on the read path, so no further response is read after this.
+		c.mutex.Lock()
+		c.stopped = err == nil
+		c.mutex.Unlock()
+		ack <- err
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err = <-ack:
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the next codec's traffic is not JSON; leave the wire log behind.
+	conn := c.c
+	if w, ok := conn.(*wireConn); ok {
+		conn = w.ReadWriteCloser
+	}
+	return &upgradedConn{Reader: afterJSON(c.dec, conn), WriteCloser: conn}, nil
+}
+
+//
+// afterJSON returns a reader for what follows the last value `dec` decoded
+// from `r`. The newline json.Encoder writes after every value is consumed, so
+// the upgrade acknowledgement and request must be written by one.
+//
+func afterJSON(dec *json.Decoder, r io.Reader) io.Reader {
+	rest := io.MultiReader(dec.Buffered(), r)
+	var newline [1]byte
+	io.ReadFull(rest, newline[:])
+	return rest
+}
+
+// upgradedConn is the connection handed to an upgraded codec: bytes the JSON
+// decoder had buffered are read first.
+type upgradedConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// reserved methods are served by dockerpc itself; MethodFormatter does not
+// apply to them.
+const reservedPrefix = "_dockerpc."
+
+// the reserved method used to negotiate a codec upgrade.
+const upgradeMethod = reservedPrefix + "Upgrade"
+
+// the reserved method listing the plugin's methods, see Client.Methods.
+const methodsMethod = reservedPrefix + "Methods"
+
+var errUpgraded = errors.New("dockerpc: codec was upgraded")
+
+//
+// stream starts a streaming call. Every response the server marks with
+// `"stream": true` is delivered on the returned channel; the first response
+// without it ends the stream and closes the channel.
+//
+// The channel is also closed when ctx is done or the connection fails.
+//
+func (c *clientCodec) stream(ctx context.Context, method string, param interface{}) (*StreamCall, error) {
+	s := &StreamCall{
+		ch:   make(chan json.RawMessage),
+		done: make(chan struct{}),
+	}
+	s.C = s.ch
+
+	id, err := c.send(method, param, func(resp *clientResponse, err error) bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.closed {
+			return true
+		}
+
+		if err != nil {
+			s.finish(err)
+			return true
+		}
+
+		if !resp.Stream {
+			x, err := resp.serverError(true)
+			if err == nil && x != "" {
+				err = remoteError(x)
+			}
+			s.finish(err)
+			return true
+		}
+
+		var chunk json.RawMessage
+		if resp.Result != nil {
+			chunk = *resp.Result
+		}
+
+		select {
+		case s.ch <- chunk:
+			return false
+		case <-ctx.Done():
+			s.finish(ctx.Err())
+			return true
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.forget(id)
+			s.mutex.Lock()
+			if !s.closed {
+				s.finish(ctx.Err())
+			}
+			s.mutex.Unlock()
+		case <-s.done:
+		}
+	}()
+
+	return s, nil
+}
+
+//
+// StreamCall is a streaming call in progress, as returned by CallStream.
+//
+type StreamCall struct {
+	// C delivers the values the server sends, and is closed when the
+	// stream ends; Err then tells why.
+	C <-chan json.RawMessage
+
+	mutex  sync.Mutex // held while delivering a value
+	ch     chan json.RawMessage
+	done   chan struct{}
+	closed bool
+
+	errMutex sync.Mutex // protects err
+	err      error
+}
+
+//
+// Err returns the error that ended the stream: the plugin's (an
+// rpc.ServerError or *RPCError), the connection's, or the context's. It is
+// nil while the stream is open, and if the server ended it normally.
+//
+func (s *StreamCall) Err() error {
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+	return s.err
+}
+
+// finish ends the stream with `err`; the caller must hold s.mutex.
+func (s *StreamCall) finish(err error) {
+	s.errMutex.Lock()
+	s.err = err
+	s.errMutex.Unlock()
+
+	s.closed = true
+	close(s.ch)
+	close(s.done)
+}
+
+//
+// batch writes all of `calls` in a single write and waits for every
+// response, filling in each call's Reply or Error.
+//
+func (c *clientCodec) batch(ctx context.Context, calls []BatchCall) error {
+	var (
+		mutex     sync.Mutex // protects calls once requests are out
+		abandoned bool
+		done      = make(chan struct{}, len(calls))
+		ids       = make([]uint64, len(calls))
+		buf       bytes.Buffer
+	)
+
+	enc := json.NewEncoder(&buf)
+
+	c.mutex.Lock()
+	for i := range calls {
+		call := &calls[i]
+		ids[i] = c.nextID()
+
+		wireID, err := c.wireID(ids[i])
+		if err != nil {
+			c.mutex.Unlock()
+			c.forget(ids[:i]...)
+			return err
+		}
+		req := c.request(call.Method, wireID)
+		req.Params[0] = call.Args
+		if err := enc.Encode(&req); err != nil {
+			c.mutex.Unlock()
+			c.forget(ids[:i+1]...)
+			return err
+		}
+
+		c.handlers[ids[i]] = func(resp *clientResponse, err error) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if abandoned {
+				return true
+			}
+
+			if err == nil {
+				var x string
+				x, err = resp.serverError(c.jsonrpc2)
+				if err == nil && x != "" {
+					err = remoteError(x)
+				}
+				if err == nil && call.Reply != nil && resp.Result != nil {
+					if err = json.Unmarshal(*resp.Result, call.Reply); err != nil {
+						err = c.decodeError(call.Method, *resp.Result, call.Reply, err)
+					}
+				}
+			}
+			call.Error = err
+			done <- struct{}{}
+			return true
+		}
+	}
+	c.mutex.Unlock()
+
+	c.wmu.Lock()
+	_, err := c.c.Write(buf.Bytes())
+	if err == nil {
+		err = c.flush()
+	}
+	c.wmu.Unlock()
+
+	if err != nil {
+		c.forget(ids...)
+		return err
+	}
+
+	for range calls {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			mutex.Lock()
+			abandoned = true
+			mutex.Unlock()
+			c.forget(ids...)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+var (
+	errNotStarted = errors.New("dockerpc: client is not started")
+	errNeedsCodec = errors.New("dockerpc: not supported after a codec upgrade")
+)
+
+//
+// RPCError is a structured error returned by the plugin: a JSON-RPC 2.0
+// error object, or a 1.0 error sent as an object rather than a string.
+// Plain string errors are still returned as rpc.ServerError.
+//
+type RPCError struct {
+	Code    int
+	Message string
+	Data    json.RawMessage // null or absent if the error had no data
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// PanicCode is the RPCError code a Server answers with when the handler of
+// a call panics; the Client returns such errors as *PanicError.
+const PanicCode = -32001
+
+//
+// PanicError is returned by calls whose handler panicked in the plugin's
+// Server. The plugin serves on; the panic only failed the call.
+//
+type PanicError struct {
+	Value string    // the panic value, as formatted by %v
+	Stack string    // the handler's stack, if the Server has PanicStack set
+	Err   *RPCError // as sent, with PanicCode
+}
+
+func (e *PanicError) Error() string {
+	return "dockerpc: plugin panicked: " + e.Value
+}
+
+func (e *PanicError) Unwrap() error {
+	return e.Err
+}
+
+//
+// DecodeError is returned when the result of a call does not fit its reply,
+// e.g. because the plugin's reply type changed. The call fails, but the
+// session carries on.
+//
+type DecodeError struct {
+	Method   string
+	Response json.RawMessage // the result, as received
+	Type     reflect.Type    // type of the reply it was decoded into
+	Err      error           // from encoding/json
+}
+
+// how much of the response a DecodeError message quotes.
+const decodeErrorQuote = 256
+
+func (e *DecodeError) Error() string {
+	response := string(e.Response)
+	if len(response) > decodeErrorQuote {
+		response = response[:decodeErrorQuote] + "..."
+	}
+	return fmt.Sprintf("dockerpc: cannot decode the reply of %s into %s: %s; response: %s", e.Method, e.Type, e.Err, response)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// marks an error object encoded as a net/rpc error string. The random part
+// keeps a plain string error from the plugin from ever passing for one.
+var rpcErrorPrefix = "\x00dockerpc.RPCError." + randomHex(8) + ":"
+
+// randomHex returns `n` random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("dockerpc: cannot read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// remoteError returns the error for a server error string.
+func remoteError(x string) error {
+	if !strings.HasPrefix(x, rpcErrorPrefix) {
+		return rpc.ServerError(x)
+	}
+
+	var obj struct {
+		Code    json.Number     `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(x[len(rpcErrorPrefix):]), &obj); err != nil {
+		return rpc.ServerError(x)
+	}
+	code, _ := obj.Code.Int64()
+	rpcErr := &RPCError{Code: int(code), Message: obj.Message, Data: obj.Data}
+	if rpcErr.Code != PanicCode {
+		return rpcErr
+	}
+
+	var data panicData
+	if json.Unmarshal(obj.Data, &data) != nil {
+		data.Value = obj.Message
+	}
+	return &PanicError{Value: data.Value, Stack: data.Stack, Err: rpcErr}
+}
+
+// panicData is the data of a PanicCode error.
+type panicData struct {
+	Value string `json:"value"`
+	Stack string `json:"stack,omitempty"`
+}
@@ -0,0 +1,382 @@
+package dockerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ManagedLabel is set on every container created by dockerpc.
+const ManagedLabel = "dockerpc.managed"
+
+//
+// createOptions builds the options for creating the plugin container from
+// DockerConfig and DockerHostConfig. The configs are copied, so Start never
+// modifies what the caller set.
+//
+func (d *Client) createOptions() docker.CreateContainerOptions {
+	config := &docker.Config{}
+	if d.DockerConfig != nil {
+		*config = *d.DockerConfig
+	}
+
+	// the RPC transport needs stdin open.
+	config.OpenStdin = true
+	if d.dockerImage != "" {
+		config.Image = d.dockerImage
+	}
+
+	labels := envLabels(d.LabelEnvPrefix)
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels[ManagedLabel] = "true"
+	if d.SessionID != "" {
+		labels[SessionLabel] = d.SessionID
+	}
+	config.Labels = labels
+
+	hostConfig := &docker.HostConfig{}
+	if d.DockerHostConfig != nil {
+		*hostConfig = *d.DockerHostConfig
+	}
+
+	return docker.CreateContainerOptions{
+		Name:       d.name,
+		Platform:   d.platform,
+		Config:     config,
+		HostConfig: hostConfig,
+	}
+}
+
+// envLabels returns the labels named by environment variables with `prefix`.
+func envLabels(prefix string) map[string]string {
+	labels := make(map[string]string)
+	if prefix == "" {
+		return labels
+	}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, prefix) {
+			continue
+		}
+		i := strings.Index(e, "=")
+		if i <= len(prefix) {
+			continue
+		}
+		key := strings.ToLower(strings.Replace(e[len(prefix):i], "_", ".", -1))
+		labels[key] = e[i+1:]
+	}
+	return labels
+}
+
+// how many names SetUniqueName tries before giving up.
+const maxUniqueNameAttempts = 100
+
+//
+// createContainer creates the container, and if ReplaceExisting is set,
+// replaces a managed container that is in the way of the requested name,
+// or with SetUniqueName, tries the next free name.
+//
+func (d *Client) createContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	c, err := d.dockerClient.CreateContainer(opts)
+
+	if err == docker.ErrContainerAlreadyExists && d.uniqueName {
+		base := opts.Name
+		for i := 2; err == docker.ErrContainerAlreadyExists && i <= maxUniqueNameAttempts; i++ {
+			opts.Name = fmt.Sprintf("%s-%d", base, i)
+			c, err = d.dockerClient.CreateContainer(opts)
+		}
+		return c, err
+	}
+
+	if err != docker.ErrContainerAlreadyExists || !d.ReplaceExisting {
+		return c, err
+	}
+
+	existing, err := d.dockerClient.InspectContainerWithContext(opts.Name, opts.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.Config == nil || existing.Config.Labels[ManagedLabel] != "true" {
+		return nil, fmt.Errorf("container %s already exists and is not managed by dockerpc; not replacing it", opts.Name)
+	}
+
+	err = d.dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: existing.ID, Force: true, Context: opts.Context})
+	if err != nil {
+		return nil, err
+	}
+
+	return d.dockerClient.CreateContainer(opts)
+}
+
+//
+// stopContainer stops the container gracefully, giving it StopTimeout
+// seconds before SIGKILL, but no longer than `ctx` allows, keeping a second
+// of it for removing the container afterwards.
+//
+func (d *Client) stopContainer(ctx context.Context) error {
+	timeout := d.StopTimeout
+	if timeout == 0 && d.CloseMode == CloseGraceful {
+		timeout = defaultGracefulStop
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline) - time.Second
+		if left < 0 {
+			left = 0
+		}
+		if secs := uint(left / time.Second); secs < timeout {
+			timeout = secs
+		}
+	}
+	return d.dockerClient.StopContainerWithContext(d.ID, timeout, ctx)
+}
+
+// CloseMode selects what Close does with the container.
+type CloseMode int
+
+const (
+	// CloseByFields, the zero value, leaves it to RemoveOnClose,
+	// StopOnClose, StopTimeout and KillOnClose.
+	CloseByFields CloseMode = iota
+
+	// CloseForce force-removes the container right away, killing the
+	// plugin.
+	CloseForce
+
+	// CloseGraceful stops the container (its stop signal, then SIGKILL
+	// after StopTimeout seconds, or 10 if that is not set), then removes
+	// it.
+	CloseGraceful
+
+	// CloseDetach only ends the RPC session, and leaves the container
+	// running, for AttachStreamingContainer to pick up again later.
+	CloseDetach
+)
+
+func (m CloseMode) String() string {
+	switch m {
+	case CloseByFields:
+		return "by fields"
+	case CloseForce:
+		return "force"
+	case CloseGraceful:
+		return "graceful"
+	case CloseDetach:
+		return "detach"
+	}
+	return fmt.Sprintf("CloseMode(%d)", int(m))
+}
+
+// the grace period of CloseGraceful without a StopTimeout, as for docker stop.
+const defaultGracefulStop = 10
+
+// closeTeardown is what Close does with the container.
+type closeTeardown struct {
+	stop   bool // gracefully, see stopContainer
+	remove bool
+	kept   bool // for KeepOnError
+}
+
+// teardown returns what Close does with the container, see CloseMode.
+func (d *Client) teardown() closeTeardown {
+	switch {
+	case d.CloseMode == CloseDetach:
+		return closeTeardown{}
+	case d.KeepOnError && d.errored.Load():
+		return closeTeardown{stop: true, kept: true}
+	case d.CloseMode == CloseForce:
+		return closeTeardown{remove: true}
+	case d.CloseMode == CloseGraceful:
+		return closeTeardown{stop: true, remove: true}
+	case !d.RemoveOnClose:
+		return closeTeardown{stop: d.StopOnClose}
+	}
+	return closeTeardown{stop: d.StopTimeout > 0 && !d.KillOnClose, remove: true}
+}
+
+// requireContainer returns an error unless the container has been created.
+func (d *Client) requireContainer() error {
+	if d.dockerClient == nil || d.ID == "" {
+		return errNotStarted
+	}
+	return nil
+}
+
+//
+// UpdateResources changes the resource limits (memory, CPU...) of the running
+// container, without restarting it or the RPC session.
+//
+func (d *Client) UpdateResources(ctx context.Context, opts docker.UpdateContainerOptions) error {
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+	opts.Context = ctx
+	return d.dockerClient.UpdateContainer(d.ID, opts)
+}
+
+//
+// EffectiveResources inspects the container and returns its resource limits
+// (memory, CPU, block IO, pids, ulimits...) as the daemon has them now, e.g.
+// to confirm that UpdateResources took effect. Only the resource fields of
+// the HostConfig are set; the rest are left zero.
+//
+func (d *Client) EffectiveResources(ctx context.Context) (docker.HostConfig, error) {
+	if err := d.requireContainer(); err != nil {
+		return docker.HostConfig{}, err
+	}
+	c, err := d.dockerClient.InspectContainerWithContext(d.ID, ctx)
+	if err != nil {
+		return docker.HostConfig{}, err
+	}
+	if c.HostConfig == nil {
+		return docker.HostConfig{}, fmt.Errorf("dockerpc: container %s was inspected without its host config", d.ID)
+	}
+	return resources(c.HostConfig), nil
+}
+
+// resources returns the resource limits of `hc`, as UpdateResources sets them.
+func resources(hc *docker.HostConfig) docker.HostConfig {
+	return docker.HostConfig{
+		Memory:             hc.Memory,
+		MemoryReservation:  hc.MemoryReservation,
+		MemorySwap:         hc.MemorySwap,
+		MemorySwappiness:   hc.MemorySwappiness,
+		KernelMemory:       hc.KernelMemory,
+		OOMKillDisable:     hc.OOMKillDisable,
+		OomScoreAdj:        hc.OomScoreAdj,
+		CPUShares:          hc.CPUShares,
+		CPUSet:             hc.CPUSet,
+		CPUSetCPUs:         hc.CPUSetCPUs,
+		CPUSetMEMs:         hc.CPUSetMEMs,
+		CPUQuota:           hc.CPUQuota,
+		CPUPeriod:          hc.CPUPeriod,
+		CPURealtimePeriod:  hc.CPURealtimePeriod,
+		CPURealtimeRuntime: hc.CPURealtimeRuntime,
+		NanoCPUs:           hc.NanoCPUs,
+		BlkioWeight:        hc.BlkioWeight,
+		PidsLimit:          hc.PidsLimit,
+		Ulimits:            hc.Ulimits,
+		ShmSize:            hc.ShmSize,
+		RestartPolicy:      hc.RestartPolicy,
+	}
+}
+
+//
+// ResizeTTY sets the terminal size of a container created with a TTY
+// (Config.Tty), so that interactive plugins render correctly. Callers
+// forward terminal changes themselves, e.g. on SIGWINCH. The docker client
+// cannot cancel a resize, so `ctx` is only checked before it is sent.
+//
+func (d *Client) ResizeTTY(ctx context.Context, height, width int) error {
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.dockerClient.ResizeContainerTTY(d.ID, height, width)
+}
+
+//
+// Changes lists the paths the plugin created, modified or deleted in the
+// container's writable layer, for auditing what a plugin wrote.
+//
+func (d *Client) Changes(ctx context.Context) ([]docker.Change, error) {
+	if err := d.requireContainer(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.dockerClient.ContainerChanges(d.ID)
+}
+
+//
+// WaitExit blocks until the plugin container stops, and returns its exit
+// code; for plugins that run to completion, such as batch jobs. It returns
+// ctx.Err() promptly if `ctx` is done first.
+//
+func (d *Client) WaitExit(ctx context.Context) (int, error) {
+	if err := d.requireContainer(); err != nil {
+		return 0, err
+	}
+	code, err := d.dockerClient.WaitContainerWithContext(d.ID, ctx)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return code, err
+}
+
+// signals are the signal names Signal accepts, without the SIG prefix.
+var signals = map[string]docker.Signal{
+	"ABRT": docker.SIGABRT, "ALRM": docker.SIGALRM, "CHLD": docker.SIGCHLD,
+	"CONT": docker.SIGCONT, "HUP": docker.SIGHUP, "INT": docker.SIGINT,
+	"IO": docker.SIGIO, "KILL": docker.SIGKILL, "PIPE": docker.SIGPIPE,
+	"PROF": docker.SIGPROF, "PWR": docker.SIGPWR, "QUIT": docker.SIGQUIT,
+	"STOP": docker.SIGSTOP, "SYS": docker.SIGSYS, "TERM": docker.SIGTERM,
+	"TRAP": docker.SIGTRAP, "TSTP": docker.SIGTSTP, "TTIN": docker.SIGTTIN,
+	"TTOU": docker.SIGTTOU, "URG": docker.SIGURG, "USR1": docker.SIGUSR1,
+	"USR2": docker.SIGUSR2, "VTALRM": docker.SIGVTALRM, "WINCH": docker.SIGWINCH,
+	"XCPU": docker.SIGXCPU, "XFSZ": docker.SIGXFSZ,
+}
+
+//
+// Signal sends the signal named `sig` ("HUP", "SIGUSR1"...) to the plugin
+// process, e.g. to make it reload its config or dump its state, without an
+// RPC method. Unlike Close, it does not stop the container, unless the
+// signal does.
+//
+func (d *Client) Signal(ctx context.Context, sig string) error {
+	signal, ok := signals[strings.TrimPrefix(strings.ToUpper(sig), "SIG")]
+	if !ok {
+		return fmt.Errorf("unknown signal: %q", sig)
+	}
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+	return d.dockerClient.KillContainer(docker.KillContainerOptions{ID: d.ID, Signal: signal, Context: ctx})
+}
+
+// ErrOOMKilled is returned by calls that failed because the plugin container
+// was killed by the OOM killer.
+var ErrOOMKilled = errors.New("dockerpc: plugin container was killed for running out of memory")
+
+// brokenConn reports whether a call failed because the connection broke.
+func brokenConn(err error) bool {
+	return err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+//
+// callError turns a broken connection error from a call into ErrOOMKilled if
+// that is why the connection broke, and error objects from the plugin into
+// an *RPCError. Other errors are returned unchanged. It also records for
+// KeepOnError that the session had errors.
+//
+func (d *Client) callError(ctx context.Context, err error) error {
+	if x, ok := err.(rpc.ServerError); ok {
+		err = remoteError(string(x))
+	}
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		d.errored.Store(true)
+	}
+	if !brokenConn(err) {
+		return err
+	}
+	if d.requireContainer() != nil {
+		return err
+	}
+
+	c, inspectErr := d.dockerClient.InspectContainerWithContext(d.ID, ctx)
+	if inspectErr == nil && c.State.OOMKilled {
+		return ErrOOMKilled
+	}
+	return err
+}
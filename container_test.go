@@ -0,0 +1,358 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// namedContainers makes `daemon` keep its containers by name, with
+// `labels`, so that creating one of a name in use conflicts.
+type namedContainers struct {
+	mutex  sync.Mutex
+	labels map[string]map[string]string
+}
+
+func newNamedContainers(daemon *testDaemon) *namedContainers {
+	named := &namedContainers{labels: make(map[string]map[string]string)}
+	daemon.route("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		named.mutex.Lock()
+		defer named.mutex.Unlock()
+		name := r.URL.Query().Get("name")
+		if _, ok := named.labels[name]; ok {
+			writeJSON(w, 409, map[string]string{"message": `Conflict. The container name "/` + name + `" is already in use`})
+			return
+		}
+		named.labels[name] = map[string]string{ManagedLabel: "true"}
+		writeJSON(w, 201, map[string]string{"Id": name})
+	})
+	daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		named.mutex.Lock()
+		defer named.mutex.Unlock()
+		labels, ok := named.labels[r.PathValue("id")]
+		if !ok {
+			writeJSON(w, 404, map[string]string{"message": "No such container"})
+			return
+		}
+		c := testContainer()
+		c.ID, c.Name = r.PathValue("id"), "/"+r.PathValue("id")
+		c.Config.Labels = labels
+		writeJSON(w, 200, c)
+	})
+	daemon.route("DELETE /containers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		named.mutex.Lock()
+		defer named.mutex.Unlock()
+		delete(named.labels, r.PathValue("id"))
+		w.WriteHeader(204)
+	})
+	return named
+}
+
+func TestReplaceExisting(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace bool
+		labels  map[string]string // of the existing container
+		err     string            // "" for success
+	}{
+		{"managed", true, map[string]string{ManagedLabel: "true"}, ""},
+		{"unmanaged", true, map[string]string{"app": "db"}, "container worker already exists and is not managed by dockerpc; not replacing it"},
+		{"no ReplaceExisting", false, map[string]string{ManagedLabel: "true"}, docker.ErrContainerAlreadyExists.Error()},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		named := newNamedContainers(daemon)
+		named.labels["worker"] = test.labels
+		d := attachedClient(t, daemon, func(d *Client) {
+			d.ReplaceExisting = test.replace
+		})
+
+		opts := docker.CreateContainerOptions{Name: "worker", Config: &docker.Config{Image: "image"}}
+		c, err := d.createContainer(opts)
+		if got := errString(err); got != test.err {
+			t.Errorf("%s: createContainer = %q, want %q", test.name, got, test.err)
+		}
+		removes := len(daemon.requestsTo("DELETE", "/containers/worker"))
+		if test.err == "" {
+			if c == nil || c.ID != "worker" || removes != 1 {
+				t.Errorf("%s: created %+v after %d removes", test.name, c, removes)
+			}
+			continue
+		}
+		if removes != 0 {
+			t.Errorf("%s: removed the existing container", test.name)
+		}
+		named.mutex.Lock()
+		if !reflect.DeepEqual(named.labels["worker"], test.labels) {
+			t.Errorf("%s: the existing container was replaced", test.name)
+		}
+		named.mutex.Unlock()
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	for _, oom := range []bool{true, false} {
+		daemon := newTestDaemon(t)
+		d := newAttachedClient(t, daemon, nil)
+		daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+			c := testContainer()
+			c.State = docker.State{Status: "exited", ExitCode: 137, OOMKilled: oom}
+			writeJSON(w, 200, c)
+		})
+
+		// a plugin error is not a broken connection, whatever the state.
+		var reply string
+		if err := d.Call("Echo.Fail", "no", &reply); errors.Is(err, ErrOOMKilled) {
+			t.Errorf("oom %v: a failed call returned %v", oom, err)
+		}
+
+		daemon.dropConns()
+		err := d.CallContext(context.Background(), "Echo.Echo", "killed", &reply)
+		switch {
+		case oom && err != ErrOOMKilled:
+			t.Errorf("call on the OOM-killed plugin = %v, want ErrOOMKilled", err)
+		case !oom && (err == nil || err == ErrOOMKilled):
+			t.Errorf("call on the exited plugin = %v, want the broken connection", err)
+		}
+	}
+}
+
+func TestResizeTTY(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.route("POST /containers/{id}/resize", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	if err := NewClient("", "image", daemon.endpoint()).ResizeTTY(context.Background(), 24, 80); err != errNotStarted {
+		t.Errorf("ResizeTTY before Start = %v, want %v", err, errNotStarted)
+	}
+	d := startedClient(t, daemon, nil)
+
+	if err := d.ResizeTTY(context.Background(), 24, 80); err != nil {
+		t.Fatal(err)
+	}
+	reqs := daemon.requestsTo("POST", "/containers/plugin/resize")
+	if len(reqs) != 1 {
+		t.Fatalf("sent %d resizes", len(reqs))
+	}
+	if query := reqs[0].URL.Query(); query.Get("h") != "24" || query.Get("w") != "80" {
+		t.Errorf("resized with %s, want h=24&w=80", query.Encode())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.ResizeTTY(ctx, 50, 132); err != context.Canceled {
+		t.Errorf("ResizeTTY with a canceled context = %v", err)
+	}
+	if reqs := daemon.requestsTo("POST", "/containers/plugin/resize"); len(reqs) != 1 {
+		t.Error("sent a resize with a canceled context")
+	}
+}
+
+func TestSignal(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := startedClient(t, daemon, nil)
+
+	tests := []struct {
+		sig  string
+		want string // the signal number sent, "" for an invalid name
+	}{
+		{"HUP", "1"},
+		{"SIGUSR1", "10"},
+		{"usr2", "12"},
+		{"SigTerm", "15"},
+		{"WINCH", "28"},
+		{"", ""},
+		{"SIG", ""},
+		{"HANGUP", ""},
+		{"1", ""},
+		{"SIGSIGHUP", ""},
+	}
+	for _, test := range tests {
+		before := len(daemon.requestsTo("POST", "/containers/plugin/kill"))
+		err := d.Signal(context.Background(), test.sig)
+		kills := daemon.requestsTo("POST", "/containers/plugin/kill")[before:]
+
+		if test.want == "" {
+			if err == nil || len(kills) != 0 {
+				t.Errorf("Signal(%q) = %v, with %d kills; want it refused", test.sig, err, len(kills))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Signal(%q) = %v", test.sig, err)
+			continue
+		}
+		if len(kills) != 1 || kills[0].URL.Query().Get("signal") != test.want {
+			t.Errorf("Signal(%q) sent %d kills, %v; want signal %s", test.sig, len(kills), kills, test.want)
+		}
+	}
+
+	if err := NewClient("", "image", "").Signal(context.Background(), "HUP"); err != errNotStarted {
+		t.Errorf("Signal before Start = %v, want %v", err, errNotStarted)
+	}
+}
+
+func TestWaitExit(t *testing.T) {
+	daemon := newTestDaemon(t)
+	exit := make(chan struct{})
+	daemon.route("POST /containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		<-exit
+		writeJSON(w, 200, map[string]int{"StatusCode": 3})
+	})
+	// the daemon holds the wait until the test ends, for the cancel.
+	t.Cleanup(func() { close(exit) })
+	d := startedClient(t, daemon, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	began := time.Now()
+	if code, err := d.WaitExit(ctx); err != context.DeadlineExceeded || code != 0 {
+		t.Errorf("WaitExit on a running container = %d, %v; want the context error", code, err)
+	}
+	if elapsed := time.Since(began); elapsed > 2*time.Second {
+		t.Errorf("WaitExit returned %v after its deadline", elapsed)
+	}
+
+	if _, err := NewClient("", "image", "").WaitExit(context.Background()); err != errNotStarted {
+		t.Errorf("WaitExit before Start = %v, want %v", err, errNotStarted)
+	}
+}
+
+func TestWaitExitCode(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.route("POST /containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]int{"StatusCode": 3})
+	})
+	d := startedClient(t, daemon, nil)
+	if code, err := d.WaitExit(context.Background()); err != nil || code != 3 {
+		t.Errorf("WaitExit = %d, %v; want 3", code, err)
+	}
+}
+
+func TestLabelEnvPrefix(t *testing.T) {
+	t.Setenv("DOCKERPC_LABEL_COM_EXAMPLE_TEAM", "infra")
+	t.Setenv("DOCKERPC_LABEL_TIER", "batch")
+	t.Setenv("DOCKERPC_LABEL_OWNER", "env")
+	t.Setenv("DOCKERPC_LABEL_", "nameless")
+	t.Setenv("OTHER_LABEL_TIER", "other")
+
+	createdLabels := func(configure func(d *Client)) map[string]string {
+		daemon := newTestDaemon(t)
+		startedClient(t, daemon, configure)
+		var body struct{ Labels map[string]string }
+		json.NewDecoder(daemon.requestsTo("POST", "/containers/create")[0].Body).Decode(&body)
+		return body.Labels
+	}
+
+	labels := createdLabels(func(d *Client) {
+		d.LabelEnvPrefix = "DOCKERPC_LABEL_"
+		d.DockerConfig = &docker.Config{Labels: map[string]string{"owner": "config"}}
+	})
+	want := map[string]string{
+		"com.example.team": "infra",
+		"tier":             "batch",
+		"owner":            "config",
+		ManagedLabel:       "true",
+	}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("created the container with labels %v, want %v", labels, want)
+	}
+
+	if labels := createdLabels(nil); !reflect.DeepEqual(labels, map[string]string{ManagedLabel: "true"}) {
+		t.Errorf("without a prefix, created the container with labels %v", labels)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.route("GET /containers/{id}/changes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, []docker.Change{
+			{Path: "/data", Kind: docker.ChangeModify},
+			{Path: "/data/out.json", Kind: docker.ChangeAdd},
+			{Path: "/tmp/lock", Kind: docker.ChangeDelete},
+		})
+	})
+	if _, err := NewClient("", "image", "").Changes(context.Background()); err != errNotStarted {
+		t.Errorf("Changes before Start = %v, want %v", err, errNotStarted)
+	}
+	d := startedClient(t, daemon, nil)
+
+	changes, err := d.Changes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []docker.Change{
+		{Path: "/data", Kind: docker.ChangeModify},
+		{Path: "/data/out.json", Kind: docker.ChangeAdd},
+		{Path: "/tmp/lock", Kind: docker.ChangeDelete},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got changes %v, want %v", changes, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Changes(ctx); err != context.Canceled {
+		t.Errorf("Changes with a canceled context = %v", err)
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	tests := []struct {
+		name  string
+		taken []string // container names in use
+		want  string
+	}{
+		{"free", nil, "worker"},
+		{"taken", []string{"worker"}, "worker-2"},
+		{"taken twice", []string{"worker", "worker-2"}, "worker-3"},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		named := newNamedContainers(daemon)
+		for _, name := range test.taken {
+			named.labels[name] = map[string]string{"app": "other"}
+		}
+		d := startedClient(t, daemon, func(d *Client) {
+			d.SetUniqueName("worker")
+		})
+
+		if d.ID != test.want {
+			t.Errorf("%s: started %q, want %q", test.name, d.ID, test.want)
+		}
+		if creates := daemon.requestsTo("POST", "/containers/create"); len(creates) != len(test.taken)+1 {
+			t.Errorf("%s: created %d times", test.name, len(creates))
+		}
+		var reply string
+		if err := d.Call("Echo.Echo", "unique", &reply); err != nil || reply != "unique" {
+			t.Errorf("%s: got %q, %v from %s", test.name, reply, err, d.ID)
+		}
+	}
+}
+
+func TestUniqueNameRunsOut(t *testing.T) {
+	daemon := newTestDaemon(t)
+	named := newNamedContainers(daemon)
+	named.labels["worker"] = nil
+	for i := 2; i <= maxUniqueNameAttempts+1; i++ {
+		named.labels[fmt.Sprintf("worker-%d", i)] = nil
+	}
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+	d.SetUniqueName("worker")
+
+	if err := d.Start(); err != docker.ErrContainerAlreadyExists {
+		t.Errorf("Start = %v, want %v", err, docker.ErrContainerAlreadyExists)
+	}
+	if creates := daemon.requestsTo("POST", "/containers/create"); len(creates) != maxUniqueNameAttempts {
+		t.Errorf("tried %d names, want %d", len(creates), maxUniqueNameAttempts)
+	}
+}
@@ -0,0 +1,79 @@
+package dockerpc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// deadlineConn applies the Client's ReadTimeout and WriteTimeout to the
+// attached connection, so that a stuck daemon or plugin fails the connection
+// instead of blocking a call forever.
+//
+// Every write gets the write timeout. Reads only get the read timeout while
+// a call is waiting for a response (between await and its release), and it
+// is extended by every read that makes progress: an idle session, with no
+// calls in flight, never times out.
+//
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mutex   sync.Mutex // protects waiting
+	waiting int        // calls waiting for a response
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout <= 0 {
+		return c.Conn.Write(b)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	defer c.Conn.SetWriteDeadline(time.Time{})
+	return c.Conn.Write(b)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mutex.Lock()
+		if c.waiting > 0 {
+			c.setReadDeadline()
+		}
+		c.mutex.Unlock()
+	}
+	return n, err
+}
+
+// setReadDeadline starts the read timeout over; the caller holds c.mutex.
+func (c *deadlineConn) setReadDeadline() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+}
+
+//
+// await marks a call as waiting for a response, which arms the read timeout,
+// and returns the function to call once it no longer waits. It is a no-op on
+// a nil conn or without a read timeout.
+//
+func (c *deadlineConn) await() (release func()) {
+	if c == nil || c.readTimeout <= 0 {
+		return func() {}
+	}
+
+	c.mutex.Lock()
+	c.waiting++
+	if c.waiting == 1 {
+		c.setReadDeadline()
+	}
+	c.mutex.Unlock()
+
+	return func() {
+		c.mutex.Lock()
+		c.waiting--
+		if c.waiting == 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.mutex.Unlock()
+	}
+}
@@ -0,0 +1,45 @@
+package dockerpc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	d := newTestClient(t, func(d *Client) {
+		d.ReadTimeout = 50 * time.Millisecond
+	})
+
+	// an idle session does not time out.
+	time.Sleep(100 * time.Millisecond)
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("Call after idling = %q, %v", reply, err)
+	}
+
+	var slept time.Duration
+	if err := d.Call("Echo.Sleep", time.Second, &slept); err == nil {
+		t.Error("a call slower than ReadTimeout succeeded")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// nobody reads the other end.
+	conn, plugin := net.Pipe()
+	defer plugin.Close()
+	c := &deadlineConn{Conn: conn, writeTimeout: 20 * time.Millisecond}
+
+	if _, err := c.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("blocked Write = %v, want a deadline error", err)
+	}
+
+	// the deadline is cleared after each write.
+	go plugin.Read(make([]byte, 1))
+	time.Sleep(40 * time.Millisecond)
+	if _, err := c.Write([]byte("y")); err != nil {
+		t.Errorf("Write after the timeout = %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package dockerpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDecodeError(t *testing.T) {
+	var mutex sync.Mutex
+	var handled []*DecodeError
+	d := newTestClient(t, func(d *Client) {
+		d.DecodeErrorHandler = func(err *DecodeError) {
+			mutex.Lock()
+			handled = append(handled, err)
+			mutex.Unlock()
+		}
+	})
+
+	// a string reply long enough to be truncated, decoded into an int.
+	long := strings.Repeat("x", 300)
+	calls := []struct {
+		name string
+		call func(reply *int) error
+	}{
+		{"Call", func(reply *int) error {
+			return d.Call("Echo.Echo", long, reply)
+		}},
+		{"CallContext", func(reply *int) error {
+			return d.CallContext(context.Background(), "Echo.Echo", long, reply)
+		}},
+		{"CallBatch", func(reply *int) error {
+			calls := []BatchCall{{Method: "Echo.Echo", Args: long, Reply: reply}}
+			if err := d.CallBatch(context.Background(), calls); err != nil {
+				return err
+			}
+			return calls[0].Error
+		}},
+	}
+	for _, test := range calls {
+		mutex.Lock()
+		handled = nil
+		mutex.Unlock()
+
+		var reply int
+		err := test.call(&reply)
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			t.Fatalf("%s: got %v, want a *DecodeError", test.name, err)
+		}
+		if de.Method != "Echo.Echo" || de.Type != reflect.TypeOf(&reply) || string(de.Response) != `"`+long+`"` {
+			t.Errorf("%s: got %+v", test.name, de)
+		}
+		quoted := `"` + long[:decodeErrorQuote-1] + "..."
+		if msg := de.Error(); !strings.HasSuffix(msg, "response: "+quoted) {
+			t.Errorf("%s: message %q does not end with the truncated response", test.name, msg)
+		}
+
+		mutex.Lock()
+		if len(handled) != 1 || handled[0] != de {
+			t.Errorf("%s: handler got %v, want the returned error", test.name, handled)
+		}
+		mutex.Unlock()
+
+		// the session survives the bad reply.
+		var echo string
+		if err := d.Call("Echo.Echo", "after", &echo); err != nil || echo != "after" {
+			t.Fatalf("%s: Call after the decode error = %q, %v", test.name, echo, err)
+		}
+	}
+}
+
+func TestDecodeErrorShortResponse(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	var reply int
+	err := d.Call("Echo.Echo", "short", &reply)
+	if err == nil || !strings.HasSuffix(err.Error(), `response: "short"`) {
+		t.Errorf("got %v, want the whole response quoted", err)
+	}
+}
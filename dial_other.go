@@ -0,0 +1,12 @@
+//go:build !windows
+
+package dockerpc
+
+import (
+	"errors"
+	"net"
+)
+
+func dialPipe(addr string) (net.Conn, error) {
+	return nil, errors.New("dockerpc: npipe endpoints are only supported on Windows")
+}
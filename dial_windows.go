@@ -0,0 +1,14 @@
+//go:build windows
+
+package dockerpc
+
+import (
+	"net"
+
+	winio "github.com/Microsoft/go-winio"
+)
+
+// dialPipe connects to a Windows named pipe, like \\.\pipe\docker_engine.
+func dialPipe(addr string) (net.Conn, error) {
+	return winio.DialPipe(addr, nil)
+}
@@ -1,20 +1,26 @@
 package dockerpc
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/rpc"
-	"net/rpc/jsonrpc"
-	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 )
@@ -25,125 +31,1321 @@ import (
 type Client struct {
 	ID           string       // internal ID of docker container
 	name         string       // name to use
+	uniqueName   bool         // name is a base to make unique, see SetUniqueName
+	tty          bool         // the container has a TTY, see IsTTY
 	dockerImage  string       // docker image to use
-	stdErrBuf    bytes.Buffer // buffer for storing stderr logs
+	platform     string       // os/arch of the image variant, see SetPlatform
+	imageDigest  string       // what the image resolved to, see PinDigest
+	stdErrBuf    stderrBuffer // buffer for storing stderr logs
 	endpoint     string
 	output       io.Writer
 	dockerClient *docker.Client
 	rpcClient    *rpc.Client
+	codec        *clientCodec
+	pipes        *dockerPipes
 	clientConn   net.Conn
+	deadlines    *deadlineConn // clientConn, once the RPC session is set up
+	stdErrLine   func(line string)
+	stdin        io.Reader // fed to the container by StartLogging, see StreamStdin
+	eventHandler func(event docker.APIEvents)
+	events       *eventListener
+	wireLog      io.Writer
+	codecFactory CodecFactory          // for NewConnClient; nil for the default codec
+	middleware   []TransportMiddleware // see WithTransportMiddleware
+	secrets      map[string][]byte     // see AddSecret
+	stopStats    []context.CancelFunc
+	mutex        sync.Mutex // protects closed, rpcClient, codec, clientConn, events, stopStats and upgrading
+	closed       bool
+	upgrading    chan struct{}                   // closed when the running UpgradeCodec returns
+	attachOpts   docker.AttachToContainerOptions // as last attached, for Reconnect
+	reconnecting sync.Mutex                      // serializes Reconnect
+	errored      atomic.Bool                     // a call failed, see KeepOnError
+	callSlots    chan struct{}                   // semaphore for MaxConcurrentCalls
+	history      callHistory                     // see CallHistorySize
 
-	DockerHostConfig *docker.HostConfig // host config parameters when starting docker
-	DockerConfig     *docker.Config     // config parameters when starting docker
+	DockerHostConfig    *docker.HostConfig               // host config parameters, applied when creating the container
+	DockerConfig        *docker.Config                   // config parameters when starting docker
+	DockerAttachOptions *docker.AttachToContainerOptions // which streams to attach; defaults to stdin, stdout and stderr, and Start needs the first two
+
+	// StopTimeout, if set, makes Close stop the container gracefully (stop
+	// signal, then SIGKILL after StopTimeout seconds) before removing it.
+	// By default the container is force-removed right away. With
+	// CloseContext, a deadline on the context that comes sooner cuts the
+	// grace period short, so that the container is killed a second before
+	// the deadline and can still be force-removed in time.
+	StopTimeout uint
+
+	// KillOnClose skips the graceful stop even if StopTimeout is set, and
+	// force-removes the container immediately; handy for high-churn tests.
+	KillOnClose bool
+
+	// CloseMode, if set, is what Close does with the container, in place of
+	// what RemoveOnClose, StopOnClose, StopTimeout and KillOnClose make it
+	// do; see the CloseMode constants. KeepOnError still applies, except
+	// with CloseDetach.
+	CloseMode CloseMode
+
+	// PollInterval is the base interval for anything that waits on the
+	// daemon or the plugin (e.g. draining calls in UpgradeCodec). Polls back
+	// off exponentially from it, with jitter so that many clients starting
+	// at once don't poll in lockstep. Defaults to 100ms.
+	PollInterval time.Duration
+
+	// PollTimeout, if set, caps the total time spent in any one wait.
+	PollTimeout time.Duration
+
+	// PinDigest makes Start resolve the image (a tag such as "latest") to
+	// its content digest the first time, and create the container from the
+	// digest, then and on every later Start; a moving tag then cannot change
+	// what the Client runs. A missing image is pulled first (without
+	// registry credentials). See ImageDigest.
+	PinDigest bool
+
+	// SessionID, if set, labels the containers the Client creates (as
+	// SessionLabel), for ReapSession to remove all those of a session.
+	SessionID string
+
+	// ReplaceExisting makes Start remove a container that already holds the
+	// requested name, and retry. Only containers carrying ManagedLabel (that
+	// is, ones created by dockerpc) are ever removed.
+	ReplaceExisting bool
+
+	// Handshake makes Start exchange protocol versions with the plugin (see
+	// ProtocolVersion) and fail if they are incompatible. The plugin must
+	// answer it with ServeHandshake.
+	Handshake        bool
+	HandshakeTimeout time.Duration // defaults to 10s
+
+	// ReadyLine, if set, makes Start wait for the plugin to write that line
+	// to stderr (see WriteReady) before any RPC, for plugins that cannot
+	// answer a Handshake. ReadyTimeout bounds the wait, and defaults to 10s.
+	// The stderr that comes before it is kept as usual. So that a line
+	// written before the attach is not missed, Start then attaches with
+	// Logs, replaying the output so far; it needs a log driver that can be
+	// read back, such as the default json-file.
+	ReadyLine    string
+	ReadyTimeout time.Duration
+
+	// FatalPattern, if set, makes Start fail as soon as the plugin writes a
+	// stderr line that matches it while Start waits for the Handshake or
+	// ReadyLine, e.g. regexp.MustCompile(`^FATAL`), rather than when the
+	// wait times out. The error quotes the line, even one written before
+	// the attach, which then replays the logs as for ReadyLine. Should the
+	// plugin exit instead, the wait ends right away too, as its streams end.
+	FatalPattern *regexp.Regexp
+
+	// HTTPClient, if set, is used for the Docker API calls (create, start,
+	// inspect, remove...), so they honor its proxy and timeout settings. It
+	// replaces the TLS transport built from CertPath or TLSConfig, so it must
+	// carry its own TLS config if the daemon needs one. The hijacked attach
+	// connection does not use it; it is dialed directly.
+	HTTPClient *http.Client
+
+	// CertPath is the directory of the ca.pem, cert.pem and key.pem used to
+	// reach a TLS daemon; it defaults to $DOCKER_CERT_PATH. TLSConfig, if
+	// set, is used instead of either, for both the API calls and the
+	// attach. They are read when the Client first connects, so that each
+	// Client can have its own TLS settings whatever the environment.
+	CertPath  string
+	TLSConfig *tls.Config
+
+	// ReadTimeout, if set, fails the connection when a call has been waiting
+	// that long without anything arriving from the plugin; an idle session
+	// never times out. This bounds calls even without a context, and unlike
+	// a context, it also unblocks the connection. WriteTimeout, if set,
+	// bounds every write to the plugin's stdin, so that a plugin that stops
+	// reading surfaces as a timeout error instead of hanging every call
+	// (it also applies to StreamStdin). Both must be set before Start.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// KeepOnError makes Close only stop the container, rather than remove
+	// it, if a call failed during the session (other than by its context
+	// being done), so that it can be examined with `docker logs` or
+	// `docker inspect`. The container id is logged.
+	KeepOnError bool
+
+	// RemoveOnClose makes Close remove the container; NewClient sets it.
+	// Clear it when the container's lifecycle is managed elsewhere, and only
+	// the RPC session should end with Close. The container is then left
+	// running, or stopped (as described on StopTimeout) if StopOnClose is
+	// set.
+	RemoveOnClose bool
+	StopOnClose   bool
+
+	// DrainOnClose makes Close end the session gracefully before tearing
+	// down the container: it calls ShutdownMethod, if set, closes the
+	// write side of the connection so the plugin reads EOF on stdin, and
+	// reads what the plugin still writes until it hangs up, for at most
+	// DrainTimeout (1s by default). The plugin then sees a clean end of its
+	// session rather than a reset connection. A docker attach only passes
+	// the EOF on to a container created with StdinOnce.
+	DrainOnClose   bool
+	ShutdownMethod string
+	DrainTimeout   time.Duration
+
+	// PostStartDelay, if set, is waited between starting the container and
+	// attaching to it, for entrypoints that are slow to begin reading stdin.
+	// AttachRetries retries a failed attach that many times, as long as the
+	// container is still running, waiting as described on PollInterval.
+	// Both are about the attach itself; waiting for the plugin's RPC server
+	// to be ready is what the Handshake is for.
+	PostStartDelay time.Duration
+	AttachRetries  int
+
+	// JSONRPC2 makes the Client speak JSON-RPC 2.0 (requests carry
+	// `"jsonrpc": "2.0"`, errors are {code, message, data} objects, returned
+	// as *RPCError) instead of the JSON-RPC 1.0 of net/rpc/jsonrpc, for
+	// plugins written in other languages. Params are still sent by
+	// position, as a one element array. It must be set before Start.
+	JSONRPC2 bool
+
+	// MethodFormatter, if set, maps the method names given to Call and
+	// friends to the names written on the wire, for plugin servers that
+	// do not use net/rpc's "Service.Method" form, e.g. strings.ToLower or
+	// one that drops the service. It does not apply to a CodecFactory's
+	// codec, nor after UpgradeCodec. It must be set before Start.
+	MethodFormatter func(method string) string
+
+	// DecodeErrorHandler, if set, is called with each call result that
+	// cannot be decoded into its reply, e.g. to log the raw response; the
+	// call itself fails with the same *DecodeError. It runs on the
+	// connection's read path, so it should not block. It does not apply to
+	// a CodecFactory's codec. It must be set before Start.
+	DecodeErrorHandler func(err *DecodeError)
+
+	// IDGenerator, if set, makes the JSON-RPC id of each request, for
+	// servers or proxies that expect string ids or their own scheme, e.g.
+	// to correlate requests with an external system. It is passed the
+	// request's sequence number (1, 2... continuing across Reconnect), and
+	// must return a value that encodes as a JSON string or number, unique
+	// among the requests in flight. Responses are matched by the id as
+	// sent. By default the sequence number itself is the id. It does not
+	// apply to a CodecFactory's codec. It must be set before Start.
+	IDGenerator func(seq uint64) interface{}
+
+	// MaxConcurrentCalls, if set, bounds the requests made by Call and
+	// CallContext that are outstanding at once, so that a busy caller does
+	// not flood a single threaded plugin; further calls wait (until their
+	// context is done) for one to complete. It must be set before Start.
+	MaxConcurrentCalls int
+
+	// CallHistorySize, if set, keeps a record of that many of the most
+	// recent calls, for CallHistory.
+	CallHistorySize int
+
+	// IdempotentMethods lists the methods that are safe to run more than
+	// once. When the connection breaks during a Call or CallContext to one
+	// of them, the Client reconnects (see Reconnect) and resends the call
+	// once, for at-least-once semantics.
+	IdempotentMethods map[string]bool
+
+	// MethodTimeouts bounds calls to the given methods (e.g. "Plugin.Slow")
+	// made by Call and CallContext; calls time out with
+	// context.DeadlineExceeded. A deadline on the context passed to
+	// CallContext takes precedence.
+	MethodTimeouts map[string]time.Duration
+
+	// DialContext, if set, dials the daemon for the attach connection in
+	// place of the built-in dial, e.g. to use a custom resolver, a SOCKS
+	// proxy or a tunnel. `network` is "tcp", or "unix" or "npipe" with the
+	// socket or pipe path as `addr`. TLS, if configured, is still applied
+	// over the returned tcp connection.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// SplitAttach makes the Client attach twice, with one connection for
+	// the container's stdin and one for its stdout and stderr, rather than
+	// one connection for both. Reads and writes then never share a socket,
+	// which avoids the half-duplex quirks some proxies and daemons have
+	// with a single hijacked connection, and lets both directions stream
+	// independently; the cost is a second attach (and connection) per
+	// plugin, and failures of the stdin side only show on the next write.
+	SplitAttach bool
+
+	// AttachHeaders override the headers of the attach request, e.g. for
+	// proxies that rewrite them. Each key replaces the default of the same
+	// name, and a key with no values removes it. The defaults are
+	// `Content-Type: text/plain`, `Connection: Upgrade` and `Upgrade: tcp`.
+	AttachHeaders http.Header
+
+	// LabelEnvPrefix, if set (conventionally "DOCKERPC_LABEL_"), labels the
+	// container from the environment of the calling process at Start: each
+	// variable named with the prefix becomes a label, keyed by the rest of
+	// the name lowercased with '_' turned into '.', so that
+	// DOCKERPC_LABEL_COM_EXAMPLE_TEAM=infra gives com.example.team=infra.
+	// Labels set in DockerConfig take precedence.
+	LabelEnvPrefix string
+
+	// MaxFrameSize bounds the payload a frame of the attach stream may
+	// declare; a larger one fails the connection rather than having the
+	// Client wait for, and buffer, a corrupt or hostile length. Defaults to
+	// DefaultMaxFrameSize.
+	MaxFrameSize uint32
+
+	// CaptureStderr keeps what the plugin writes to stderr, for StdError,
+	// DrainStderr, CallAndLog and the line handler; NewClient and
+	// NewConnClient set it. Clear it for plugins whose stderr is of no
+	// interest: stderr frames are then discarded as they are read. It must
+	// be set before Start.
+	CaptureStderr bool
+
+	// Logger, if set, receives the log lines of the Client in place of
+	// slog.Default(). Each line carries the container id, once there is
+	// one, as the "container" attribute, so that the logs of many Clients
+	// can be told apart.
+	Logger *slog.Logger
+}
+
+// Create a new dockerpc Client client
+func NewClient(name string, dockerImage string, endpoint string) *Client {
+	ret := &Client{
+		name:          name,
+		dockerImage:   dockerImage,
+		endpoint:      endpoint,
+		RemoveOnClose: true,
+		CaptureStderr: true,
+	}
+	return ret
+}
+
+// ErrClosed is returned by calls made after Close.
+var ErrClosed = errors.New("dockerpc: client is closed")
+
+// Close will remove the container, and close any client resources.
+// Closing an already closed client does nothing.
+func (d *Client) Close() error {
+	return d.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but the docker calls made during teardown are
+// bound to `ctx`, so a slow daemon cannot hang the caller. Client resources
+// are always released; ctx.Err() is returned if it cut the teardown short.
+func (d *Client) CloseContext(ctx context.Context) error {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return nil
+	}
+	d.closed = true
+	rpcClient, clientConn, events := d.rpcClient, d.clientConn, d.events
+	codec, pipes := d.codec, d.pipes
+	d.rpcClient, d.codec, d.clientConn, d.events = nil, nil, nil, nil
+	stopStats := d.stopStats
+	d.stopStats = nil
+	d.mutex.Unlock()
+
+	for _, stop := range stopStats {
+		stop()
+	}
+
+	if d.DrainOnClose && rpcClient != nil && pipes != nil {
+		d.drain(ctx, rpcClient, codec, pipes)
+	}
+
+	if events != nil {
+		events.stop(d.dockerClient)
+	}
+
+	if d.dockerClient != nil {
+		teardown := d.teardown()
+		if teardown.stop {
+			d.stopContainer(ctx)
+		}
+		if !teardown.stop && !teardown.remove && len(d.secrets) > 0 && d.ID != "" {
+			// a stopped container's tmpfs is gone already.
+			d.removeSecrets(ctx)
+		}
+		if teardown.remove {
+			opts := docker.RemoveContainerOptions{ID: d.ID, Force: true, Context: ctx}
+			d.dockerClient.RemoveContainer(opts)
+		}
+		if teardown.kept {
+			d.logger().Info("keeping container for inspection after errors in the session")
+		}
+	}
+
+	if rpcClient != nil {
+		// closing the rpc client also closes the attached connection.
+		err := rpcClient.Close()
+		if err != nil {
+			return err
+		}
+	} else if clientConn != nil {
+		err := clientConn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+//
+// Reset closes the session and removes the container like Close, then
+// clears the runtime state (ID, stderr buffer, StreamStdin input...) so that
+// the Client can be started again with its configuration (image, env,
+// binds, and so on) intact. It is handy to recycle pooled clients after a
+// plugin misbehaves.
+//
+func (d *Client) Reset() error {
+	err := d.Close()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = false
+	d.ID = ""
+	d.pipes = nil
+	d.deadlines = nil
+	d.stdin = nil
+	d.tty = false
+	d.errored.Store(false)
+	d.stdErrBuf.Reset()
+	return err
+}
+
+// CodecFactory builds an RPC client codec over the plugin connection.
+type CodecFactory func(conn io.ReadWriteCloser) rpc.ClientCodec
+
+//
+// UpgradeCodec switches the live session from JSON-RPC to the codec built by
+// `factory`, over the same connection and without restarting the container.
+//
+// It waits for outstanding calls to finish (new calls wait for the upgrade),
+// then asks the plugin to switch with a reserved "_dockerpc.Upgrade" call;
+// the plugin must be a Server with a HandleUpgrade hook serving the matching
+// server codec. Streaming and batch calls need the JSON-RPC codec and are not
+// available once upgraded.
+//
+func (d *Client) UpgradeCodec(ctx context.Context, factory CodecFactory) error {
+	d.mutex.Lock()
+	switch {
+	case d.closed:
+		d.mutex.Unlock()
+		return ErrClosed
+	case d.rpcClient == nil:
+		d.mutex.Unlock()
+		return errNotStarted
+	case d.codec == nil:
+		d.mutex.Unlock()
+		return errors.New("dockerpc: codec was already upgraded")
+	case d.upgrading != nil:
+		d.mutex.Unlock()
+		return errors.New("dockerpc: codec upgrade already in progress")
+	}
+	codec := d.codec
+	upgrading := make(chan struct{})
+	d.upgrading = upgrading
+	d.mutex.Unlock()
+
+	// new calls wait in session() until this returns; Close does not.
+	defer func() {
+		d.mutex.Lock()
+		d.upgrading = nil
+		d.mutex.Unlock()
+		close(upgrading)
+	}()
+
+	err := d.poll(ctx, func() (bool, error) {
+		if d.Closed() {
+			return false, ErrClosed
+		}
+		return codec.idle(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := codec.upgrade(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.codec != codec {
+		conn.Close()
+		return errors.New("dockerpc: session was replaced during the codec upgrade")
+	}
+
+	// the old client stops on its own once the codec stops reading.
+	d.codec = nil
+	d.rpcClient = rpc.NewClientWithCodec(factory(conn))
+	return nil
+}
+
+// Closed reports whether Close has been called.
+func (d *Client) Closed() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.closed
+}
+
+// session returns the live RPC session, or why there is none.
+func (d *Client) session() (*rpc.Client, *clientCodec, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for d.upgrading != nil {
+		upgrading := d.upgrading
+		d.mutex.Unlock()
+		<-upgrading
+		d.mutex.Lock()
+	}
+	if d.closed {
+		return nil, nil, ErrClosed
+	}
+	if d.rpcClient == nil {
+		return nil, nil, errNotStarted
+	}
+	return d.rpcClient, d.codec, nil
+}
+
+// AttachStreamingContainer will attach to a container.
+func (d *Client) AttachStreamingContainer(opts docker.AttachToContainerOptions) error {
+	return d.AttachStreamingContainerContext(context.Background(), opts)
+}
+
+//
+// AttachStreamingContainerContext is like AttachStreamingContainer, but
+// gives up on the dial and the attach request as soon as `ctx` is done,
+// returning ctx.Err() and closing the half-opened connection.
+//
+func (d *Client) AttachStreamingContainerContext(ctx context.Context, opts docker.AttachToContainerOptions) error {
+	conn, err := d.attachStream(ctx, opts)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.clientConn = conn
+	d.mutex.Unlock()
+	return nil
+}
+
+// attachStream attaches to the container, and returns the connection.
+func (d *Client) attachStream(ctx context.Context, opts docker.AttachToContainerOptions) (net.Conn, error) {
+	if !d.SplitAttach || !opts.Stdin || !(opts.Stdout || opts.Stderr) {
+		return d.attachConn(ctx, opts)
+	}
+
+	// output first, so that nothing the plugin answers is missed.
+	out := opts
+	out.Stdin = false
+	r, err := d.attachConn(ctx, out)
+	if err != nil {
+		return nil, err
+	}
+
+	in := opts
+	in.Stdout, in.Stderr = false, false
+	w, err := d.attachConn(ctx, in)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return &splitConn{Conn: r, w: w}, nil
+}
+
+// attachConn makes one attach request, and returns the hijacked connection.
+func (d *Client) attachConn(ctx context.Context, opts docker.AttachToContainerOptions) (net.Conn, error) {
+	uri := "/containers/" + opts.Container + "/attach?" + queryString(opts)
+	network, addr, err := parseEndpoint(d.endpoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rawConn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	req, err := http.NewRequest("POST", uri, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	for key, values := range d.AttachHeaders {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if network != "tcp" {
+		// a socket or named pipe has no host name, but the daemon wants a
+		// Host header.
+		req.Host = "docker"
+	}
+
+	clientconn := httputil.NewClientConn(rawConn, nil)
+	resp, err := doContext(ctx, rawConn, clientconn, req)
+
+	if resp != nil && resp.StatusCode >= 400 {
+		// the daemon refused the attach, e.g. for a container that is not
+		// running; there is no stream to hijack.
+		var msg struct{ Message string }
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &msg) != nil || msg.Message == "" {
+			msg.Message = string(bytes.TrimSpace(b))
+		}
+		rawConn.Close()
+		return nil, fmt.Errorf("dockerpc: attaching to %s: %s: %s", opts.Container, resp.Status, msg.Message)
+	}
+	if err != nil {
+		d.logger().Warn("attach request failed", "err", err)
+		rawConn.Close()
+		return nil, err
+	}
+
+	conn, br := clientconn.Hijack()
+
+	// the response parsing may have read past the headers into the stream;
+	// make sure those bytes are read before anything else from the conn.
+	if br != nil && br.Buffered() > 0 {
+		buffered, _ := br.Peek(br.Buffered())
+		return &bufferedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), conn),
+		}, nil
+	}
+
+	return conn, nil
+}
+
+//
+// doContext sends `req` over `clientconn`, which runs over `rawConn`, and
+// reads the response, failing with ctx.Err() if `ctx` is done first.
+//
+func doContext(ctx context.Context, rawConn net.Conn, clientconn *httputil.ClientConn, req *http.Request) (*http.Response, error) {
+	// unblock the request when ctx is done.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			rawConn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	resp, err := clientconn.Do(req)
+	close(stop)
+	<-stopped
+
+	if ctx.Err() != nil {
+		return resp, ctx.Err()
+	}
+	return resp, err
+}
+
+// how long probe waits on a healthy, silent connection.
+var probeTimeout = 50 * time.Millisecond
+
+//
+// probe checks that the attached connection is not already closed or
+// broken, by attempting a short read. Anything read is kept for the RPC
+// session.
+//
+func (d *Client) probe() error {
+	conn := d.clientConn
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+
+	if n > 0 {
+		d.clientConn = &bufferedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(b[:n]), conn),
+		}
+	}
+
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		return fmt.Errorf("dockerpc: attach connection is not usable: %s", err)
+	}
+	return nil
+}
+
+//
+// dial connects to the daemon for the attach, with DialContext if set. TLS
+// is applied over the dialed connection when the daemon needs it.
+//
+func (d *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	tlsConfig := d.dockerClient.TLSConfig
+	if network != "tcp" {
+		tlsConfig = nil
+	}
+
+	if d.DialContext == nil {
+		switch {
+		case network == "npipe":
+			return dialPipe(addr)
+		case tlsConfig != nil:
+			dialer := &tls.Dialer{Config: tlsConfig}
+			return dialer.DialContext(ctx, network, addr)
+		default:
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+//
+// splitConn joins the two connections of a SplitAttach: it reads the
+// container's output from the embedded Conn, and writes its stdin to `w`.
+//
+type splitConn struct {
+	net.Conn
+	w net.Conn
+}
+
+func (c *splitConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// CloseWrite closes the stdin connection, so StreamStdin can signal EOF.
+func (c *splitConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *splitConn) Close() error {
+	c.w.Close()
+	return c.Conn.Close()
+}
+
+func (c *splitConn) SetDeadline(t time.Time) error {
+	c.w.SetDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *splitConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+// bufferedConn is a net.Conn whose reads start with bytes already buffered
+// from it.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Call calls a method on the RPC server running on the client.
+//
+// `args` provide the arguments to the RPC call, results are stored in `reply`.
+//
+// Returns an error if it fails; ErrOOMKilled if the connection broke because
+// the plugin ran out of memory.
+//
+// At the end of each call, you can get the stderr log from the plugin via
+// .StdError()
+//
+func (d *Client) Call(method string, args interface{}, reply interface{}) (err error) {
+	if _, ok := d.MethodTimeouts[method]; ok || d.IdempotentMethods[method] || d.MaxConcurrentCalls > 0 {
+		return d.CallContext(context.Background(), method, args, reply)
+	}
+	defer d.trackCall(method)(&err)
+
+	rpcClient, codec, err := d.session()
+	if err != nil {
+		return err
+	}
+	d.stdErrBuf.Reset()
+	defer d.deadlines.await()()
+	box, boxed := boxReply(codec, method, reply)
+	err = rpcClient.Call(method, args, boxed)
+	return d.callError(context.Background(), box.result(err))
+}
+
+//
+// CallContext is like Call, but returns ctx.Err() as soon as `ctx` is done.
+// A call abandoned this way may still complete in the background; `reply`
+// must not be reused until then.
+//
+func (d *Client) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) (err error) {
+	defer d.trackCall(method)(&err)
+
+	if _, ok := ctx.Deadline(); !ok {
+		if timeout, ok := d.MethodTimeouts[method]; ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	rpcClient, err := d.call(ctx, method, args, reply)
+	if d.IdempotentMethods[method] && brokenConn(err) {
+		if d.resume(ctx, rpcClient) == nil {
+			_, err = d.call(ctx, method, args, reply)
+		}
+	}
+	return d.callError(ctx, err)
+}
+
+//
+// CallAndLog is like CallContext, and also returns the stderr the plugin
+// wrote during the call. Output of calls running concurrently on the same
+// Client is not told apart.
+//
+func (d *Client) CallAndLog(ctx context.Context, method string, args interface{}, reply interface{}) (stderr string, err error) {
+	err = d.CallContext(ctx, method, args, reply)
+	return d.DrainStderr(), err
+}
+
+// call makes one attempt at a call, on the current session.
+func (d *Client) call(ctx context.Context, method string, args interface{}, reply interface{}) (*rpc.Client, error) {
+	rpcClient, codec, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := d.acquireSlot(ctx)
+	if err != nil {
+		return rpcClient, err
+	}
+
+	d.stdErrBuf.Reset()
+	defer d.deadlines.await()()
+	box, boxed := boxReply(codec, method, reply)
+	call := rpcClient.Go(method, args, boxed, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		release()
+		return rpcClient, box.result(call.Error)
+	case <-ctx.Done():
+		// the request is still outstanding; keep its slot until it is done.
+		go func() {
+			<-call.Done
+			release()
+		}()
+		return rpcClient, ctx.Err()
+	}
+}
+
+//
+// acquireSlot waits for one of the MaxConcurrentCalls slots, and returns the
+// function that frees it.
+//
+func (d *Client) acquireSlot(ctx context.Context) (release func(), err error) {
+	if d.callSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case d.callSlots <- struct{}{}:
+		return func() { <-d.callSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//
+// CallRaw calls `method` and returns its result as undecoded JSON, exactly
+// as the plugin sent it, for callers that forward or lazily decode it.
+//
+func (d *Client) CallRaw(ctx context.Context, method string, args interface{}) (json.RawMessage, error) {
+	var result json.RawMessage
+	err := d.CallContext(ctx, method, args, &result)
+	return result, err
+}
+
+//
+// CallJSON is CallRaw for JSON text: `paramsJSON` is sent as the params
+// as is, without being decoded and encoded again, and the result comes back
+// as the plugin sent it; for gateways bridging a JSON API to a plugin. An
+// empty `paramsJSON` sends null.
+//
+func (d *Client) CallJSON(ctx context.Context, method string, paramsJSON string) (resultJSON string, err error) {
+	params := json.RawMessage("null")
+	if paramsJSON != "" {
+		if !json.Valid([]byte(paramsJSON)) {
+			return "", fmt.Errorf("dockerpc: CallJSON params for %s are not valid JSON", method)
+		}
+		params = json.RawMessage(paramsJSON)
+	}
+	result, err := d.CallRaw(ctx, method, params)
+	return string(result), err
+}
+
+// CallT is a typed form of Call: it constructs the reply of type `Resp`,
+// calls `method` with `req`, and returns the result.
+//
+//	greeting, err := dockerpc.CallT[string, string](client, "Plugin.SayHi", "jen")
+//
+func CallT[Req, Resp any](d *Client, method string, req Req) (Resp, error) {
+	var resp Resp
+	err := d.Call(method, req, &resp)
+	return resp, err
+}
+
+//
+// CallStream calls a streaming method on the RPC server, and returns the
+// call, whose channel C delivers the values it sends. C is closed when the
+// server ends the stream, the connection fails, or `ctx` is done; Err then
+// tells which, and returns the plugin's error if the method failed.
+//
+// The plugin must implement the method following the streaming contract
+// described on Server. Receive promptly: values are not buffered, and a slow
+// reader holds up responses to other calls.
+//
+func (d *Client) CallStream(ctx context.Context, method string, args interface{}) (*StreamCall, error) {
+	_, codec, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		return nil, errNeedsCodec
+	}
+	return codec.stream(ctx, method, args)
+}
+
+// BatchCall is one call in a CallBatch.
+type BatchCall struct {
+	Method string      // method to call, e.g. "Plugin.SayHi"
+	Args   interface{} // arguments to the call
+	Reply  interface{} // where the result is stored
+	Error  error       // set to the result of the call after CallBatch
+}
+
+//
+// CallBatch sends all of `calls` to the RPC server in a single write, saving
+// round-trips over a remote Docker endpoint, and waits for all of them to
+// complete.
+//
+// Requests are written in slice order, but the server may run them
+// concurrently and reply in any order; responses are matched to calls by
+// request id. Per-call failures are stored in each BatchCall's Error; the
+// returned error is for the batch as a whole (a failed write, or `ctx`
+// being done before every response arrived).
+//
+func (d *Client) CallBatch(ctx context.Context, calls []BatchCall) error {
+	_, codec, err := d.session()
+	if err != nil {
+		return err
+	}
+	if codec == nil {
+		return errNeedsCodec
+	}
+	d.stdErrBuf.Reset()
+	defer d.deadlines.await()()
+	err = codec.batch(ctx, calls)
+	return d.callError(ctx, err)
+}
+
+//
+// Stats returns the number of bytes that crossed the attach stream since
+// Start: `bytesIn` counts stdout and stderr payload read from the container,
+// `bytesOut` counts what was written to its stdin. The 8 byte Docker frame
+// headers are not counted.
+//
+func (d *Client) Stats() (bytesIn, bytesOut uint64) {
+	if d.pipes == nil {
+		return 0, 0
+	}
+	return d.pipes.bytesIn.Load(), d.pipes.bytesOut.Load()
+}
+
+//
+// SetStdErrLineHandler registers `handler` to be called with each line the
+// plugin writes to stderr, without the trailing newline, as it arrives.
+// Lines split across Docker frames are reassembled first, and a final line
+// without a newline is delivered when the connection ends. The handler runs
+// on the connection's read path, so it should not block.
+//
+// It must be set before Start.
+//
+func (d *Client) SetStdErrLineHandler(handler func(line string)) {
+	d.stdErrLine = handler
+}
+
+//
+// IsTTY reports whether the started plugin container has a TTY. Docker does
+// not multiplex the attach stream of such a container, so the Client reads
+// it raw; the plugin's stderr then arrives mixed with its stdout, and is not
+// captured.
+//
+func (d *Client) IsTTY() bool {
+	return d.tty
+}
+
+func (d *Client) StdError() string {
+	return d.stdErrBuf.String()
+}
+
+//
+// DrainStderr returns the stderr captured since the last call (or the last
+// drain) and clears it, in one step, so that output the read path appends
+// meanwhile is neither lost nor returned twice.
+//
+func (d *Client) DrainStderr() string {
+	return d.stdErrBuf.drain()
+}
+
+//
+// Start a docker container, and create a connection to /attach to it and send
+// and receive RPC commands.
+//
+func (d *Client) Start() error {
+	_, err := d.StartContext(context.Background())
+	return err
+}
+
+// StartResult describes the plugin container started by StartContext.
+type StartResult struct {
+	ID       string // docker container id
+	Name     string // container name, as assigned by docker if none was given
+	Image    string // image the container runs
+	Endpoint string // docker endpoint the container runs on
+}
+
+//
+// StartContext is like Start, with the docker calls bound to `ctx`, and
+// returns details of the started container for logging and correlation.
+//
+func (d *Client) StartContext(ctx context.Context) (*StartResult, error) {
+	return d.start(ctx, d.createOptions())
 }
 
-// Create a new dockerpc Client client
-func NewClient(name string, dockerImage string, endpoint string) *Client {
-	ret := &Client{
-		name:        name,
-		dockerImage: dockerImage,
-		endpoint:    endpoint,
+//
+// StartWithOptions is like StartContext, but creates the container from
+// `opts` as given, ignoring the image, name, DockerConfig, DockerHostConfig
+// and setters of the Client. Only OpenStdin is forced on (the RPC transport
+// needs it) and the Context set; the ManagedLabel is not added, so
+// ReplaceExisting will not replace such containers unless `opts` sets it.
+//
+// This is an escape hatch for settings the Client does not expose: the
+// caller is responsible for a valid config.
+//
+func (d *Client) StartWithOptions(ctx context.Context, opts docker.CreateContainerOptions) (*StartResult, error) {
+	config := &docker.Config{}
+	if opts.Config != nil {
+		*config = *opts.Config
 	}
-	return ret
+	config.OpenStdin = true
+	opts.Config = config
+
+	return d.start(ctx, opts)
 }
 
-// Close will remove the container, and close any client resources
-func (d *Client) Close() error {
+func (d *Client) start(ctx context.Context, opts docker.CreateContainerOptions) (*StartResult, error) {
+	if d.stdin != nil {
+		return nil, errStdinStreamed
+	}
+	if err := d.checkAttachOptions(); err != nil {
+		return nil, err
+	}
 
-	if d.dockerClient != nil {
-		opts := docker.RemoveContainerOptions{ID: d.ID, Force: true}
-		d.dockerClient.RemoveContainer(opts)
+	result, attachOpts, err := d.launch(ctx, opts)
+
+	if err != nil {
+		return nil, err
+	}
+	if !attachOpts.Stdin {
+		return nil, errors.New("dockerpc: the container was created without OpenStdin, which the RPC transport needs")
 	}
 
-	if d.rpcClient != nil {
-		err := d.rpcClient.Close()
-		d.rpcClient = nil
-		if err != nil {
+	// the handshake or ready line proves the connection works; without
+	// them, at least make sure the attach did not leave us with a dead one.
+	if !d.Handshake && d.ReadyLine == "" {
+		if err = d.probe(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = d.startRPC(attachOpts.Stderr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//
+// NewConnClient returns a ready Client that speaks RPC over `conn` rather
+// than a container: `conn` carries what a docker attach stream would, i.e.
+// stdout/stderr in Docker's multiplexed frames, and raw stdin. No Docker
+// calls are made, and Close just closes `conn`.
+//
+// The RPC codec is built by `factory` (e.g. a gob codec), or is the default
+// JSON-RPC codec if `factory` is nil. What is specific to the default codec
+// does not apply to one built by a factory: streaming and batch calls fail,
+// the wire log records nothing, JSONRPC2 and MethodFormatter are ignored,
+// and the session cannot Reconnect.
+//
+func NewConnClient(conn net.Conn, factory CodecFactory) *Client {
+	d := &Client{clientConn: conn, codecFactory: factory, CaptureStderr: true}
+	d.startRPC(true)
+	return d
+}
+
+// startRPC sets up the RPC session over the attached connection.
+func (d *Client) startRPC(stderr bool) error {
+	pipes := d.newPipes(d.clientConn)
+
+	// only keep a stderr buffer if we asked docker for stderr.
+	if stderr {
+		d.keepStderr(pipes)
+	}
+
+	if d.ReadyLine != "" {
+		if err := d.waitReady(d.clientConn, pipes, stderr); err != nil {
 			return err
 		}
 	}
 
-	if d.rpcClient != nil {
-		err := d.rpcClient.Close()
-		d.rpcClient = nil
+	if d.Handshake {
+		err := d.handshake(d.clientConn, pipes)
 		if err != nil {
 			return err
 		}
 	}
+
+	d.newSession(d.clientConn, pipes, 0)
 	return nil
 }
 
-// AttachStreamingContainer will attach to a container.
-func (d *Client) AttachStreamingContainer(opts docker.AttachToContainerOptions) error {
-	uri := "/containers/" + opts.Container + "/attach?" + queryString(opts)
-	u, err := url.Parse(d.endpoint + uri)
+//
+// newSession starts the RPC session over `pipes`, which read the attached
+// `conn`, with request ids continuing after `seq`.
+//
+func (d *Client) newSession(conn net.Conn, pipes *dockerPipes, seq uint64) {
+	deadlines := &deadlineConn{
+		Conn:         conn,
+		readTimeout:  d.ReadTimeout,
+		writeTimeout: d.WriteTimeout,
+	}
+	pipes.conn = deadlines
+	d.pipes = pipes
 
-	if err != nil {
-		return err
+	rwc := d.wrapTransport(pipes)
+	if d.wireLog != nil {
+		rwc = &wireConn{ReadWriteCloser: rwc, log: &wireLog{w: d.wireLog}}
 	}
 
-	var rawConn net.Conn
-	if d.dockerClient.TLSConfig != nil {
-		rawConn, err = tls.Dial("tcp", u.Host, d.dockerClient.TLSConfig)
+	var codec *clientCodec
+	var rpcClient *rpc.Client
+	if d.codecFactory != nil {
+		// the wire log, JSON-RPC settings and `seq` are for the default
+		// codec, see NewConnClient.
+		rpcClient = rpc.NewClientWithCodec(d.codecFactory(rwc))
 	} else {
-		rawConn, err = net.Dial("tcp", u.Host)
+		codec = newClientCodec(rwc)
+		codec.seq = seq
+		codec.jsonrpc2 = d.JSONRPC2
+		codec.methodName = d.MethodFormatter
+		codec.onDecodeError = d.DecodeErrorHandler
+		codec.newID = d.IDGenerator
+		rpcClient = rpc.NewClientWithCodec(codec)
 	}
+
+	d.mutex.Lock()
+	if d.MaxConcurrentCalls > 0 && d.callSlots == nil {
+		d.callSlots = make(chan struct{}, d.MaxConcurrentCalls)
+	}
+	d.clientConn = deadlines
+	d.deadlines = deadlines
+	d.codec = codec
+	d.rpcClient = rpcClient
+	d.mutex.Unlock()
+}
+
+//
+// StartLogging starts the container without RPC: it attaches, and copies the
+// container's stdout and stderr into the given writers (either may be nil to
+// discard the stream) until the output ends or `ctx` is done. This makes
+// dockerpc usable to simply run a container and stream its output.
+//
+func (d *Client) StartLogging(ctx context.Context, stdout, stderr io.Writer) error {
+	_, _, err := d.launch(ctx, d.createOptions())
+
 	if err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	req, err := http.NewRequest("POST", uri, &buf)
-	if err != nil {
+	// the read timeout is for calls; only bound the writes of StreamStdin.
+	deadlines := &deadlineConn{Conn: d.clientConn, writeTimeout: d.WriteTimeout}
+	pipes := d.newPipes(deadlines)
+	pipes.stdErr = stderr
+	d.pipes = pipes
+
+	if stdout == nil {
+		stdout = io.Discard
+	}
+
+	if d.stdin != nil {
+		go d.copyStdin(pipes)
+	}
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, pipes)
+		copied <- err
+	}()
+
+	select {
+	case err = <-copied:
 		return err
+	case <-ctx.Done():
+		// unblock the copy.
+		d.mutex.Lock()
+		conn := d.clientConn
+		d.clientConn = nil
+		d.mutex.Unlock()
+		conn.Close()
+		<-copied
+		return ctx.Err()
 	}
-	req.Header.Set("Content-Type", "plain/text")
-	req.Header.Set("Connection", "Upgrade")
-	req.Header.Set("Upgrade", "tcp")
+}
 
-	clientconn := httputil.NewClientConn(rawConn, nil)
-	resp, err := clientconn.Do(req)
+//
+// StreamStdin makes StartLogging copy `r` into the container's stdin while
+// streaming its output, to drive interactive (REPL-style) containers that do
+// not speak RPC. Once `r` is exhausted, the write side of the connection is
+// closed where the transport supports it, so the container sees EOF if it
+// was created with StdinOnce.
+//
+// It must be called before StartLogging, and is exclusive with RPC: Start
+// and StartContext fail on a Client with a stdin stream.
+//
+func (d *Client) StreamStdin(r io.Reader) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if d.rpcClient != nil || d.pipes != nil {
+		return errors.New("dockerpc: StreamStdin must be called before the container is started")
+	}
+	d.stdin = r
+	return nil
+}
 
+func (d *Client) copyStdin(pipes *dockerPipes) {
+	_, err := io.Copy(pipes, d.stdin)
 	if err != nil {
-		log.Println("Error response from socket", resp)
-		return err
+		d.logger().Warn("writing stdin failed", "err", err)
+		return
 	}
 
-	d.clientConn, _ = clientconn.Hijack()
+	pipes.Flush()
+	closeWrite(pipes.conn)
+}
 
-	return nil
+// transport returns the connection under the wrappers of the Client.
+func transport(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	if c, ok := conn.(*deadlineConn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(*bufferedConn); ok {
+		conn = c.Conn
+	}
+	return conn
 }
 
-// Call calls a method on the RPC server running on the client.
 //
-// `args` provide the arguments to the RPC call, results are stored in `reply`.
+// closeWrite closes the write side of the attached `conn`, where the
+// transport supports it, and reports whether it did.
 //
-// Returns an error if it fails.
+func closeWrite(conn io.ReadWriteCloser) bool {
+	c, ok := transport(conn).(interface{ CloseWrite() error })
+	return ok && c.CloseWrite() == nil
+}
+
+// flush pushes out what the transport under `conn` buffered, if it does.
+func flush(conn io.ReadWriteCloser) error {
+	if c, ok := transport(conn).(interface{ Flush() error }); ok {
+		return c.Flush()
+	}
+	return nil
+}
+
 //
-// At the end of each call, you can get the stderr log from the plugin via
-// .StdError()
+// Flush pushes out what was written to the plugin's stdin but is held by a
+// buffering transport. RPC requests are flushed as they are written, so
+// this is only needed for what goes to stdin otherwise, such as the stream
+// of StreamStdin before it ends.
 //
-func (d *Client) Call(method string, args interface{}, reply interface{}) error {
-	d.stdErrBuf.Reset()
-	return d.rpcClient.Call(method, args, reply)
+func (d *Client) Flush() error {
+	d.mutex.Lock()
+	pipes := d.pipes
+	d.mutex.Unlock()
+	if pipes == nil {
+		return errNotStarted
+	}
+	return pipes.Flush()
 }
 
-func (d *Client) StdError() string {
-	return string(d.stdErrBuf.Bytes())
+var errStdinStreamed = errors.New("dockerpc: a Client with StreamStdin only supports StartLogging")
+
+//
+// checkAttachOptions fails on DockerAttachOptions that the RPC transport
+// cannot run over: requests are written to the plugin's stdin, and replies
+// read from its stdout, so both must be attached.
+//
+func (d *Client) checkAttachOptions() error {
+	opts := d.DockerAttachOptions
+	if opts == nil {
+		return nil
+	}
+	if !opts.Stdin {
+		return errors.New("dockerpc: DockerAttachOptions must attach stdin, where the RPC requests go")
+	}
+	if !opts.Stdout {
+		return errors.New("dockerpc: DockerAttachOptions must attach stdout, where the RPC replies come from")
+	}
+	return nil
 }
 
 //
-// Start a docker container, and create a connection to /attach to it and send
-// and receive RPC commands.
+// connect creates the docker client, unless an earlier call (e.g.
+// BuildImage) already did.
 //
-func (d *Client) Start() (err error) {
+func (d *Client) connect() (err error) {
+	if d.dockerClient != nil {
+		return nil
+	}
+
+	// fail early on endpoints the attach cannot dial.
+	if _, _, err := parseEndpoint(d.endpoint); err != nil {
+		return err
+	}
 
-	path := os.Getenv("DOCKER_CERT_PATH")
-	if path != "" {
+	path := d.certPath()
+	if path != "" && d.TLSConfig == nil {
 		ca := fmt.Sprintf("%s/ca.pem", path)
 		cert := fmt.Sprintf("%s/cert.pem", path)
 		key := fmt.Sprintf("%s/key.pem", path)
 		d.dockerClient, err = docker.NewTLSClient(d.endpoint, cert, key, ca)
+	} else if d.TLSConfig != nil {
+		// NewClient takes tcp:// for plain http.
+		d.dockerClient, err = docker.NewClient(httpsEndpoint(d.endpoint))
 	} else {
 		d.dockerClient, err = docker.NewClient(d.endpoint)
 	}
@@ -152,133 +1354,507 @@ func (d *Client) Start() (err error) {
 		return err
 	}
 
-	defaultConfig := &docker.Config{
-		OpenStdin: true,
-		Image:     d.dockerImage,
+	if d.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = d.TLSConfig
+		d.dockerClient.HTTPClient = &http.Client{Transport: transport}
+		d.dockerClient.TLSConfig = d.TLSConfig
+	}
+
+	if d.HTTPClient != nil {
+		d.dockerClient.HTTPClient = d.HTTPClient
+	}
+
+	if d.dockerClient.TLSConfig == nil && strings.HasPrefix(d.endpoint, "https://") {
+		// no client certificate, but the attach must still speak TLS.
+		d.dockerClient.TLSConfig = &tls.Config{}
+	}
+	return nil
+}
+
+// httpsEndpoint returns `endpoint` with https for a tcp:// or http:// scheme.
+func httpsEndpoint(endpoint string) string {
+	for _, scheme := range []string{"tcp://", "http://"} {
+		if strings.HasPrefix(endpoint, scheme) {
+			return "https://" + strings.TrimPrefix(endpoint, scheme)
+		}
+	}
+	return endpoint
+}
+
+// certPath returns the TLS certificate directory: CertPath, or the
+// environment's.
+func (d *Client) certPath() string {
+	if d.CertPath != "" {
+		return d.CertPath
 	}
+	return os.Getenv("DOCKER_CERT_PATH")
+}
 
-	defaultHostConfig := &docker.HostConfig{}
+//
+// launch connects to docker, creates and starts the container, and attaches
+// to it. It returns the attach options used.
+//
+func (d *Client) launch(ctx context.Context, opts docker.CreateContainerOptions) (result *StartResult, attachOpts docker.AttachToContainerOptions, err error) {
 
-	opts := docker.CreateContainerOptions{
-		Config:     defaultConfig,
-		HostConfig: defaultHostConfig,
+	if opts.HostConfig != nil {
+		err = checkMemory(opts.HostConfig.Memory, opts.HostConfig.MemoryReservation)
+		if err != nil {
+			return nil, attachOpts, err
+		}
 	}
 
-	if d.name != "" {
-		opts.Name = d.name
+	err = d.connect()
+
+	if err != nil {
+		return nil, attachOpts, err
 	}
 
-	c, err := d.dockerClient.CreateContainer(opts)
+	err = d.checkAPIVersion(ctx)
 
 	if err != nil {
-		return err
+		return nil, attachOpts, err
+	}
+
+	opts.Context = ctx
+
+	if d.platform != "" {
+		err = d.pullForPlatform(ctx, opts.Config.Image)
+		if err != nil {
+			return nil, attachOpts, err
+		}
+	}
+
+	if d.PinDigest {
+		// createOptions made a copy of the config.
+		opts.Config.Image, err = d.pinImage(ctx, opts.Config.Image)
+		if err != nil {
+			return nil, attachOpts, err
+		}
+	}
+
+	if len(d.secrets) > 0 {
+		opts.HostConfig = secretsTmpfs(opts.HostConfig)
+	}
+
+	c, err := d.createContainer(opts)
+
+	if err != nil {
+		return nil, attachOpts, err
 	}
 
 	d.ID = c.ID
-	err = d.dockerClient.StartContainer(c.ID, defaultHostConfig)
+
+	err = d.listenEvents()
 
 	if err != nil {
-		return err
+		return nil, attachOpts, err
+	}
+
+	// the host config went with the create; API 1.24 and up, which the
+	// RPC transport needs anyway, reject one at start.
+	err = d.dockerClient.StartContainerWithContext(c.ID, nil, ctx)
+
+	if err != nil {
+		return nil, attachOpts, err
 	}
 
-	attachOpts := docker.AttachToContainerOptions{
-		Container: d.ID,
-		Stdout:    true,
-		Stdin:     true,
-		Stderr:    true,
-		Stream:    true,
+	if len(d.secrets) > 0 {
+		err = d.writeSecrets(ctx)
+		if err != nil {
+			return nil, attachOpts, err
+		}
 	}
 
-	err = d.AttachStreamingContainer(attachOpts)
+	c, err = d.checkRunning(ctx)
 
 	if err != nil {
-		return err
+		return nil, attachOpts, err
+	}
+
+	// a TTY container's attach stream is not multiplexed.
+	d.tty = c.Config != nil && c.Config.Tty
+
+	attachOpts = docker.AttachToContainerOptions{
+		Stdout: true,
+		Stdin:  true,
+		Stderr: true,
+	}
+
+	if d.DockerAttachOptions != nil {
+		attachOpts = *d.DockerAttachOptions
+	}
+	// asking for a stdin the container does not have confuses the daemon.
+	if c.Config == nil || !c.Config.OpenStdin {
+		attachOpts.Stdin = false
+	}
+	attachOpts.Container = d.ID
+	attachOpts.Stream = true
+
+	// the plugin may write its ready line, or a fatal one, before the
+	// attach: have the daemon replay its output so far first. Reconnect
+	// must not, so d.attachOpts goes without it.
+	replayOpts := attachOpts
+	if d.ReadyLine != "" || d.FatalPattern != nil {
+		replayOpts.Logs = true
+	}
+	conn, err := d.attach(ctx, replayOpts)
+
+	if err != nil {
+		return nil, attachOpts, err
+	}
+	d.mutex.Lock()
+	d.clientConn = conn
+	d.mutex.Unlock()
+	d.attachOpts = attachOpts
+
+	result = &StartResult{
+		ID:       d.ID,
+		Name:     strings.TrimPrefix(c.Name, "/"),
+		Image:    opts.Config.Image,
+		Endpoint: d.endpoint,
 	}
+	return result, attachOpts, nil
+}
+
+//
+// minAPIVersion is the oldest Docker API version whose attach endpoint
+// supports the hijacked, upgraded connection the RPC transport runs over.
+//
+const minAPIVersion = "1.24"
 
-	pipes := &dockerPipes{
-		d.clientConn,
-		&d.stdErrBuf,
-		0,
-		0,
+//
+// checkAPIVersion fails with a descriptive error if the daemon is too old
+// for the attach transport, rather than letting the hijack fail obscurely.
+//
+func (d *Client) checkAPIVersion(ctx context.Context) error {
+	env, err := d.dockerClient.VersionWithContext(ctx)
+	if err != nil {
+		return err
 	}
 
-	d.rpcClient = rpc.NewClientWithCodec(jsonrpc.NewClientCodec(pipes))
+	detected := env.Get("ApiVersion")
+	if detected == "" {
+		// nothing to compare; let the attach speak for itself.
+		return nil
+	}
 
+	version, err := docker.NewAPIVersion(detected)
+	if err != nil {
+		return err
+	}
+	required, _ := docker.NewAPIVersion(minAPIVersion)
+	if version.LessThan(required) {
+		return fmt.Errorf("docker API version %s is too old for dockerpc, need %s or later; please upgrade the docker daemon", detected, minAPIVersion)
+	}
 	return nil
 }
 
+//
+// attach attaches to the started container, after PostStartDelay, retrying
+// up to AttachRetries times while the container is still running, and
+// returns the connection.
+//
+func (d *Client) attach(ctx context.Context, opts docker.AttachToContainerOptions) (net.Conn, error) {
+	if d.PostStartDelay > 0 {
+		select {
+		case <-time.After(d.PostStartDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var conn net.Conn
+	retries := 0
+	err := d.poll(ctx, func() (bool, error) {
+		var err error
+		conn, err = d.attachStream(ctx, opts)
+		if err == nil || retries >= d.AttachRetries {
+			return true, err
+		}
+		retries++
+
+		if _, err := d.checkRunning(ctx); err != nil {
+			return true, err
+		}
+		d.logger().Info("attach failed, retrying", "err", err)
+		return false, nil
+	})
+	return conn, err
+}
+
+// how long to give a freshly started container before checking it is still up.
+var startCheckDelay = 100 * time.Millisecond
+
+//
+// checkRunning inspects the container shortly after it was started, and
+// returns it, or a descriptive error if it has already exited - most likely
+// because the image's entrypoint does not keep reading stdin.
+//
+func (d *Client) checkRunning(ctx context.Context) (*docker.Container, error) {
+	select {
+	case <-time.After(startCheckDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c, err := d.dockerClient.InspectContainerWithContext(d.ID, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.State.Running {
+		return c, nil
+	}
+
+	var stderr bytes.Buffer
+	d.dockerClient.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    d.ID,
+		ErrorStream:  &stderr,
+		OutputStream: io.Discard,
+		Stderr:       true,
+	})
+
+	return nil, fmt.Errorf("container %s exited right after start with code %d "+
+		"(does the entrypoint keep reading stdin?): %s",
+		d.ID, c.State.ExitCode, strings.TrimSpace(stderr.String()))
+}
+
 const (
 	STDIN  = 0
 	STDOUT = 1
 	STDERR = 2
 )
 
+// stderrBuffer is the stderr log, shared by the read path and callers.
+type stderrBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *stderrBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func (b *stderrBuffer) Reset() {
+	b.mutex.Lock()
+	b.buf.Reset()
+	b.mutex.Unlock()
+}
+
+func (b *stderrBuffer) drain() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := b.buf.String()
+	b.buf.Reset()
+	return s
+}
+
+// DefaultMaxFrameSize is the MaxFrameSize used if none is set.
+const DefaultMaxFrameSize = 16 << 20
+
+// newPipes returns the transport over the attached `conn`.
+func (d *Client) newPipes(conn io.ReadWriteCloser) *dockerPipes {
+	maxFrame := d.MaxFrameSize
+	if maxFrame == 0 {
+		maxFrame = DefaultMaxFrameSize
+	}
+	return &dockerPipes{conn: conn, raw: d.tty, maxFrame: maxFrame, ended: make(chan struct{})}
+}
+
+// keepStderr sends the stderr read by `pipes` to StdError and the line
+// handler, unless CaptureStderr is cleared.
+func (d *Client) keepStderr(pipes *dockerPipes) {
+	if d.CaptureStderr {
+		pipes.stdErr = &d.stdErrBuf
+		pipes.stdErrLine = d.stdErrLine
+	}
+}
+
 // todo close everything
 type dockerPipes struct {
 	conn           io.ReadWriteCloser
-	stdErrBuf      *bytes.Buffer
+	stdErr         io.Writer // where stderr goes; nil if it is not kept
+	stdErrLine     func(line string)
+	stderrReads    bool       // Read also returns after stderr, see waitReady
+	raw            bool       // the stream has no frames, as for a TTY
+	maxFrame       uint32     // largest frame payload accepted
+	lineMutex      sync.Mutex // protects partialLine, as Close flushes it
+	partialLine    []byte     // stderr received since the last newline
 	bytesRemaining uint32
 	pipeName       byte
+	ended          chan struct{} // closed once Read fails, if not nil
+	endOnce        sync.Once
+	buffered       *bufio.Reader // what was read from conn, see reader
+
+	bytesIn  atomic.Uint64 // payload bytes read, excluding frame headers
+	bytesOut atomic.Uint64 // bytes written to stdin
 }
 
 func (pipe *dockerPipes) Read(b []byte) (int, error) {
-	// try to read n bytes from the connection
-	// this is the Docker header as described here:
-	// https://docs.docker.com/reference/api/docker_remote_api_v1.20/#attach-to-a-container
-	if pipe.bytesRemaining == 0 {
-		var p []byte = make([]byte, 1024)
-		c, err := pipe.conn.Read(p)
-		if err != nil {
-			return 0, err
+	n, err := pipe.read(b)
+	if err != nil && pipe.ended != nil {
+		pipe.endOnce.Do(func() { close(pipe.ended) })
+	}
+	return n, err
+}
+
+//
+// reader returns the buffer reads go through: frames are consumed from it,
+// so several of them arriving in one read of the connection are all kept,
+// and small frames cost no read each. It reads whatever conn is at the
+// time, as newSession swaps in the deadlineConn.
+//
+func (pipe *dockerPipes) reader() *bufio.Reader {
+	if pipe.buffered == nil {
+		pipe.buffered = bufio.NewReaderSize(pipeConn{pipe}, pipeBufferSize)
+	}
+	return pipe.buffered
+}
+
+// the size of the read buffer of the transport.
+const pipeBufferSize = 32 << 10
+
+// pipeConn reads the current conn of a dockerPipes.
+type pipeConn struct {
+	pipe *dockerPipes
+}
+
+func (c pipeConn) Read(b []byte) (int, error) {
+	return c.pipe.conn.Read(b)
+}
+
+func (pipe *dockerPipes) read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	r := pipe.reader()
+	if pipe.raw {
+		c, err := r.Read(b)
+		pipe.bytesIn.Add(uint64(c))
+		return c, err
+	}
+
+	// stdin and stderr frames are consumed here rather than returned as
+	// empty reads, so that a plugin logging a lot to stderr cannot stall
+	// the codec; Read only returns with stdout data or an error (unless
+	// stderrReads is set).
+	for {
+		// try to read n bytes from the connection
+		// this is the Docker header as described here:
+		// https://docs.docker.com/reference/api/docker_remote_api_v1.20/#attach-to-a-container
+		if pipe.bytesRemaining == 0 {
+			// the header usually arrives with (some of) the payload, or
+			// split across reads; take exactly its 8 bytes, and leave
+			// whatever came after them in the buffer.
+			var header [8]byte
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				// the plugin is gone; its last line may lack a newline.
+				pipe.flushLine()
+				return 0, err
+			}
+			size := binary.BigEndian.Uint32(header[4:])
+
+			if size > pipe.maxFrame {
+				return 0, fmt.Errorf("Docker frame of %d bytes exceeds the %d byte MaxFrameSize", size, pipe.maxFrame)
+			}
+
+			pipe.pipeName = header[0]
+			pipe.bytesRemaining = size
+			if size == 0 {
+				continue
+			}
 		}
 
-		if c != 8 {
-			return 0, errors.New("Expected 8 byte header from Docker")
+		// don't read past the frame: if the supplied byte array is smaller
+		// than the rest of it, the next Read() continues the frame rather
+		// than looking for a Docker header.
+		buf := b
+		if uint32(len(buf)) > pipe.bytesRemaining {
+			buf = buf[:pipe.bytesRemaining]
 		}
-		var size uint32
-		sizeReader := bytes.NewReader(p[4:])
-		binary.Read(sizeReader, binary.BigEndian, &size)
 
-		pipe.pipeName = p[0]
-		pipe.bytesRemaining = size
-	}
+		pipeName := pipe.pipeName
+		c, err := r.Read(buf)
 
-	pipeName := pipe.pipeName
-	c, err := pipe.conn.Read(b)
+		if err != nil {
+			pipe.flushLine()
+			return 0, err
+		}
 
-	if err != nil {
-		return 0, err
-	}
+		pipe.bytesIn.Add(uint64(c))
+		pipe.bytesRemaining -= uint32(c)
 
-	// handle if the supplied byte array is smaller than the total size.
-	// if we haven't read the full # of bytes, then on the next Read()
-	// don't try to re-read the Docker header, simply continue reading the buffer.
-	bufSize := uint32(len(b))
+		switch pipeName {
+		case STDIN:
+			continue
+		case STDOUT:
+			return c, nil
+		case STDERR:
+			// standard error - write it to buf, if we are keeping one.
+			if pipe.stdErr != nil {
+				pipe.stdErr.Write(buf[0:c])
+			}
+			if pipe.stdErrLine != nil {
+				pipe.writeLines(buf[0:c])
+			}
+			if pipe.stderrReads {
+				return 0, nil
+			}
+			continue
+		}
 
-	if bufSize < pipe.bytesRemaining {
-		pipe.bytesRemaining = pipe.bytesRemaining - bufSize
-	} else {
-		pipe.bytesRemaining = 0
+		return 0, errors.New(fmt.Sprintf("Unsupported pipe: %d ", pipeName))
 	}
+}
 
-	switch pipeName {
-	case STDIN:
-		return 0, nil
-	case STDOUT:
-		return c, nil
-	case STDERR:
-		// standard error - write it to buf.
-		pipe.stdErrBuf.Write(b[0:c])
-		return 0, nil
+// writeLines passes each complete stderr line in `b` to the line handler,
+// holding on to any trailing partial line until the rest of it arrives.
+func (pipe *dockerPipes) writeLines(b []byte) {
+	pipe.lineMutex.Lock()
+	defer pipe.lineMutex.Unlock()
+	pipe.partialLine = append(pipe.partialLine, b...)
+	for {
+		i := bytes.IndexByte(pipe.partialLine, '\n')
+		if i < 0 {
+			break
+		}
+		pipe.stdErrLine(string(pipe.partialLine[:i]))
+		pipe.partialLine = pipe.partialLine[i+1:]
 	}
-
-	return 0, errors.New(fmt.Sprintf("Unsupported pipe: %d ", pipeName))
 }
 
 func (pipe *dockerPipes) Write(b []byte) (int, error) {
-	return pipe.conn.Write(b)
+	n, err := pipe.conn.Write(b)
+	pipe.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+// Flush pushes out the writes the connection buffered.
+func (pipe *dockerPipes) Flush() error {
+	return flush(pipe.conn)
+}
+
+// flushLine passes a pending partial stderr line to the line handler.
+func (pipe *dockerPipes) flushLine() {
+	pipe.lineMutex.Lock()
+	defer pipe.lineMutex.Unlock()
+	if len(pipe.partialLine) > 0 && pipe.stdErrLine != nil {
+		pipe.stdErrLine(string(pipe.partialLine))
+	}
+	pipe.partialLine = nil
 }
 
 func (pipe *dockerPipes) Close() error {
+	pipe.flushLine()
 	return pipe.conn.Close()
 }
@@ -0,0 +1,81 @@
+package dockerpc_test
+
+import (
+	"context"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/jandre/dockerpc"
+	"github.com/jandre/dockerpc/dockerpctest"
+)
+
+func TestCall(t *testing.T) {
+	client := dockerpctest.NewClient()
+	defer client.Close()
+
+	tests := []struct {
+		method string
+		args   string
+		reply  string
+		err    error
+		stderr string
+	}{
+		{"Echo.Echo", "hello", "hello", nil, "echo: hello\n"},
+		{"Echo.Echo", "", "", nil, "echo: \n"},
+		{"Echo.Fail", "boom", "", rpc.ServerError("boom"), ""},
+		{"Echo.Missing", "x", "", rpc.ServerError("rpc: can't find method Echo.Missing"), ""},
+	}
+	for _, test := range tests {
+		var reply string
+		err := client.Call(test.method, test.args, &reply)
+		if reply != test.reply || err != test.err {
+			t.Errorf("%s(%q): got %q, %v; want %q, %v", test.method, test.args, reply, err, test.reply, test.err)
+		}
+		if stderr := client.StdError(); stderr != test.stderr {
+			t.Errorf("%s(%q): got stderr %q, want %q", test.method, test.args, stderr, test.stderr)
+		}
+	}
+}
+
+func TestCallContextTimeout(t *testing.T) {
+	client := dockerpctest.NewClient()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var reply time.Duration
+	if err := client.CallContext(ctx, "Echo.Sleep", time.Second, &reply); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestCallAfterClose(t *testing.T) {
+	client := dockerpctest.NewClient()
+	client.Close()
+
+	var reply string
+	if err := client.Call("Echo.Echo", "late", &reply); err != dockerpc.ErrClosed {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestService(t *testing.T) {
+	client := dockerpctest.NewClient()
+	defer client.Close()
+	echo := client.Service("Echo")
+
+	var reply string
+	if err := echo.Call("Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Errorf("Call = %q, %v", reply, err)
+	}
+	if err := echo.CallContext(context.Background(), "Fail", "boom", &reply); err != rpc.ServerError("boom") {
+		t.Errorf("CallContext = %v", err)
+	}
+	if err := client.Service("Other").Call("Echo", "hi", &reply); err == nil {
+		t.Error("call to an unknown service succeeded")
+	}
+}
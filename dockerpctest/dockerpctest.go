@@ -0,0 +1,107 @@
+//
+// Package dockerpctest provides an in-process echo plugin, so that code built
+// on dockerpc (timeouts, error handling, stderr capture...) can be tested
+// without Docker. It is meant to be used from tests only.
+//
+//	client := dockerpctest.NewClient()
+//	defer client.Close()
+//
+//	var reply string
+//	err := client.Call("Echo.Echo", "hello", &reply)
+//
+package dockerpctest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jandre/dockerpc"
+)
+
+//
+// Echo is the RPC service the echo plugin registers as "Echo".
+//
+type Echo struct {
+	stderr io.Writer
+}
+
+// Echo replies with `msg`, and writes "echo: <msg>" to the plugin's stderr.
+func (e *Echo) Echo(msg string, reply *string) error {
+	fmt.Fprintf(e.stderr, "echo: %s\n", msg)
+	*reply = msg
+	return nil
+}
+
+// Sleep waits for `d` (nanoseconds on the wire) before replying with it.
+func (e *Echo) Sleep(d time.Duration, reply *time.Duration) error {
+	time.Sleep(d)
+	*reply = d
+	return nil
+}
+
+// Fail returns an error with message `msg`.
+func (e *Echo) Fail(msg string, reply *string) error {
+	return errors.New(msg)
+}
+
+//
+// NewClient returns a dockerpc Client connected to a new echo plugin over an
+// in-memory connection. Closing the client stops the plugin.
+//
+func NewClient() *dockerpc.Client {
+	client, plugin := net.Pipe()
+	go Serve(plugin)
+	return dockerpc.NewConnClient(client, nil)
+}
+
+//
+// Serve runs the echo plugin on `conn`, writing its stdout and stderr in
+// Docker's multiplexed attach format, until `conn` is closed.
+//
+func Serve(conn net.Conn) error {
+	var mutex sync.Mutex
+	stdout := &frameWriter{mutex: &mutex, w: conn, stream: 1}
+	stderr := &frameWriter{mutex: &mutex, w: conn, stream: 2}
+
+	s := dockerpc.NewServer()
+	if err := s.RegisterName("Echo", &Echo{stderr: stderr}); err != nil {
+		return err
+	}
+	return s.ServeConn(&pluginConn{Reader: conn, Writer: stdout, Closer: conn})
+}
+
+// pluginConn is the plugin's view of the attach stream: raw stdin in, framed
+// stdout out.
+type pluginConn struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// frameWriter writes to one stream of a Docker attach connection.
+type frameWriter struct {
+	mutex  *sync.Mutex // shared by the streams of a connection
+	w      io.Writer
+	stream byte
+}
+
+// Write sends `b` as one frame, header and payload in a single write, as the
+// daemon does.
+func (f *frameWriter) Write(b []byte) (int, error) {
+	frame := make([]byte, 8+len(b))
+	frame[0] = f.stream
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(b)))
+	copy(frame[8:], b)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, err := f.w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,46 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/rpc"
+	"time"
+)
+
+// how long Close waits for the plugin to hang up, see DrainOnClose.
+var defaultDrainTimeout = time.Second
+
+//
+// drain ends the session over `pipes` as described on DrainOnClose. The
+// RPC client keeps reading the connection meanwhile, so the plugin's last
+// replies and stderr are consumed rather than left unread.
+//
+func (d *Client) drain(ctx context.Context, rpcClient *rpc.Client, codec *clientCodec, pipes *dockerPipes) {
+	timeout := d.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if d.ShutdownMethod != "" {
+		// the reply is of no interest, but must not fail to decode: that
+		// would end the RPC client's reads.
+		var reply json.RawMessage
+		_, boxed := boxReply(codec, d.ShutdownMethod, &reply)
+		call := rpcClient.Go(d.ShutdownMethod, nil, boxed, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+		}
+	}
+
+	if !closeWrite(pipes.conn) && d.ShutdownMethod == "" {
+		// nothing tells the plugin the session is over.
+		return
+	}
+	select {
+	case <-pipes.ended:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,122 @@
+package dockerpc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection, which, unlike
+// net.Pipe, can be half-closed.
+func tcpPair(t *testing.T) (client, plugin net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin = <-accepted
+	if plugin == nil {
+		t.Fatal("accept failed")
+	}
+	return client, plugin
+}
+
+// errReader records the error that ended the reads of a Reader.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func TestDrainOnClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		drain    bool
+		shutdown string // ShutdownMethod
+		stderr   string // StdError after Close
+	}{
+		{"abrupt", false, "", ""},
+		{"drain", true, "", "bye\n"},
+		{"shutdown method", true, "Echo.Echo", "echo: \nbye\n"},
+	}
+	for _, test := range tests {
+		client, plugin := tcpPair(t)
+		type ending struct {
+			stdin error // that ended the plugin's reads
+			bye   error // writing after stdin ended
+		}
+		ended := make(chan ending, 1)
+		go func() {
+			defer plugin.Close()
+			stdin := &errReader{r: plugin}
+			servePlugin(stdin, plugin, io.NopCloser(nil))
+			// the plugin says goodbye once its stdin is done.
+			time.Sleep(20 * time.Millisecond)
+			var mutex sync.Mutex
+			bye := (&frames{mutex: &mutex, w: plugin, stream: STDERR}).Write
+			_, err := bye([]byte("bye\n"))
+			ended <- ending{stdin.err, err}
+		}()
+
+		d := &Client{clientConn: client, CaptureStderr: true, DrainOnClose: test.drain, ShutdownMethod: test.shutdown}
+		if err := d.startRPC(true); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+			t.Fatalf("%s: got %q, %v", test.name, reply, err)
+		}
+		d.stdErrBuf.Reset()
+		if err := d.Close(); err != nil {
+			t.Errorf("%s: Close = %v", test.name, err)
+		}
+
+		end := <-ended
+		if test.drain && (end.stdin != io.EOF || end.bye != nil) {
+			t.Errorf("%s: plugin's stdin ended with %v, and its goodbye with %v; want a clean EOF", test.name, end.stdin, end.bye)
+		}
+		if got := d.StdError(); got != test.stderr {
+			t.Errorf("%s: StdError = %q, want %q", test.name, got, test.stderr)
+		}
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	// the plugin never hangs up.
+	client, plugin := tcpPair(t)
+	defer plugin.Close()
+	go io.Copy(io.Discard, bufio.NewReader(plugin))
+
+	d := &Client{clientConn: client, DrainOnClose: true, DrainTimeout: 50 * time.Millisecond}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := d.Close()
+	if err != nil && !strings.Contains(err.Error(), "closed") {
+		t.Errorf("Close = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %s, past the DrainTimeout", elapsed)
+	}
+}
@@ -0,0 +1,38 @@
+package dockerpc
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//
+// parseEndpoint returns the network and address to dial for a Docker
+// endpoint such as "tcp://127.0.0.1:2376", "unix:///var/run/docker.sock"
+// or, on Windows, "npipe:////./pipe/docker_engine". "http://" and
+// "https://" endpoints are dialed over tcp too; for "https://" the docker
+// client is set up for TLS by connect.
+//
+func parseEndpoint(endpoint string) (network, addr string, err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case "npipe":
+		// npipe:////./pipe/docker_engine -> \\.\pipe\docker_engine
+		return "npipe", strings.Replace(u.Path, "/", "\\", -1), nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("docker endpoint %q has no socket path", endpoint)
+		}
+		return "unix", u.Path, nil
+	case "tcp", "http", "https":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("docker endpoint %q has no host", endpoint)
+		}
+		return "tcp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("unsupported docker endpoint %q: use tcp://, unix:// or npipe://", endpoint)
+}
@@ -0,0 +1,116 @@
+package dockerpc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		network  string
+		addr     string
+		ok       bool
+	}{
+		{"tcp://127.0.0.1:2376", "tcp", "127.0.0.1:2376", true},
+		{"http://docker:2375", "tcp", "docker:2375", true},
+		{"https://docker:2376", "tcp", "docker:2376", true},
+		{"unix:///var/run/docker.sock", "unix", "/var/run/docker.sock", true},
+		{"npipe:////./pipe/docker_engine", "npipe", `\\.\pipe\docker_engine`, true},
+		{"unix://", "", "", false},
+		{"tcp://", "", "", false},
+		{"ftp://docker:21", "", "", false},
+		{"docker:2375", "", "", false},
+	}
+	for _, test := range tests {
+		network, addr, err := parseEndpoint(test.endpoint)
+		if (err == nil) != test.ok || network != test.network || addr != test.addr {
+			t.Errorf("parseEndpoint(%q) = %q, %q, %v; want %q, %q", test.endpoint, network, addr, err, test.network, test.addr)
+		}
+	}
+}
+
+func TestHTTPSEndpointUsesTLS(t *testing.T) {
+	d := NewClient("", "image", "https://docker:2376")
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if d.dockerClient.TLSConfig == nil {
+		t.Error("https endpoint without TLS")
+	}
+}
+
+func TestCertPath(t *testing.T) {
+	t.Setenv("DOCKER_CERT_PATH", "/env/certs")
+
+	tests := []struct {
+		certPath string
+		want     string
+	}{
+		{"", "/env/certs"},
+		{"/client/certs", "/client/certs"},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "tcp://docker:2376")
+		d.CertPath = test.certPath
+		if got := d.certPath(); got != test.want {
+			t.Errorf("CertPath %q: using %q, want %q", test.certPath, got, test.want)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Setenv("DOCKER_CERT_PATH", "/env/certs")
+
+	var mutex sync.Mutex
+	var requests []*http.Request
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r)
+		mutex.Unlock()
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, scheme := range []string{"tcp://", "http://", "https://"} {
+		mutex.Lock()
+		requests = nil
+		mutex.Unlock()
+		d := NewClient("", "image", scheme+server.Listener.Addr().String())
+		d.TLSConfig = config
+		if err := d.connect(); err != nil {
+			t.Fatal(err)
+		}
+		if d.dockerClient.TLSConfig != config {
+			t.Errorf("%s: the attach does not use TLSConfig", scheme)
+		}
+		if err := d.dockerClient.Ping(); err != nil {
+			t.Errorf("%s: Ping = %v", scheme, err)
+		}
+		mutex.Lock()
+		if len(requests) != 1 || requests[0].TLS == nil {
+			t.Errorf("%s: the API calls are not made over TLS", scheme)
+		}
+		mutex.Unlock()
+	}
+}
+
+func TestHTTPSEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"tcp://docker:2376", "https://docker:2376"},
+		{"http://docker:2376", "https://docker:2376"},
+		{"https://docker:2376", "https://docker:2376"},
+		{"unix:///var/run/docker.sock", "unix:///var/run/docker.sock"},
+	}
+	for _, test := range tests {
+		if got := httpsEndpoint(test.endpoint); got != test.want {
+			t.Errorf("httpsEndpoint(%q) = %q, want %q", test.endpoint, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package dockerpc
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// SetEventHandler registers `handler` to be called with the Docker events
+// (start, die, oom...) of the plugin container, so that callers can react to
+// it dying out of band instead of finding out on the next Call. Events are
+// delivered in order on a dedicated goroutine, from container creation until
+// Close.
+//
+// It must be set before Start.
+//
+func (d *Client) SetEventHandler(handler func(event docker.APIEvents)) {
+	d.eventHandler = handler
+}
+
+// eventListener is the subscription feeding an event handler.
+type eventListener struct {
+	ch   chan *docker.APIEvents
+	done chan struct{}
+}
+
+//
+// listenEvents subscribes the event handler, if any, to the events of the
+// container.
+//
+func (d *Client) listenEvents() error {
+	if d.eventHandler == nil {
+		return nil
+	}
+
+	l := &eventListener{
+		ch:   make(chan *docker.APIEvents, 16),
+		done: make(chan struct{}),
+	}
+	opts := docker.EventsOptions{
+		Filters: map[string][]string{"container": {d.ID}},
+	}
+	if err := d.dockerClient.AddEventListenerWithOptions(opts, l.ch); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	d.events = l
+	d.mutex.Unlock()
+
+	id, handler := d.ID, d.eventHandler
+	go func() {
+		for {
+			select {
+			case event, ok := <-l.ch:
+				if !ok {
+					return
+				}
+				// the daemon connection may be shared with other
+				// listeners, whose filters win.
+				if event.ID != id && event.Actor.ID != id {
+					continue
+				}
+				handler(*event)
+			case <-l.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stop unsubscribes the listener and ends its goroutine.
+func (l *eventListener) stop(client *docker.Client) {
+	client.RemoveEventListener(l.ch)
+	close(l.done)
+}
@@ -0,0 +1,48 @@
+package dockerpc
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestEventHandler(t *testing.T) {
+	now := time.Now().Unix()
+	daemon := newTestDaemon(t)
+	daemon.events = make(chan docker.APIEvents, 3)
+	daemon.events <- docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "other"}, Time: now}
+	daemon.events <- docker.APIEvents{Type: "container", Action: "oom", Actor: docker.APIActor{ID: "plugin"}, Time: now}
+	daemon.events <- docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "plugin", Attributes: map[string]string{"exitCode": "137"}}, Time: now}
+
+	events := make(chan docker.APIEvents, 16)
+	d := startedClient(t, daemon, func(d *Client) {
+		d.SetEventHandler(func(event docker.APIEvents) { events <- event })
+	})
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case event := <-events:
+			got = append(got, event.Action+" "+event.Actor.ID+" "+event.Actor.Attributes["exitCode"])
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got events %q, then none", got)
+		}
+	}
+	// the client hands each event to the listeners on its own goroutine,
+	// so they may come out of order.
+	sort.Strings(got)
+	if want := []string{"die plugin 137", "oom plugin "}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+	if query := daemon.requestsTo("GET", "/events")[0].URL.Query(); !strings.Contains(query.Get("filters"), `"container":["plugin"]`) {
+		t.Errorf("listened to events with %s", query.Encode())
+	}
+
+	d.Close()
+	if d.events != nil {
+		t.Error("the listener outlived Close")
+	}
+}
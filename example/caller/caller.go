@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/jandre/dockerpc"
@@ -20,20 +21,21 @@ func main() {
 		log.Fatal(err)
 	}
 
+	ctx := context.Background()
 	name := "jen"
 	var result string
-	err = client.Call("Plugin.SayHi", name, &result)
+	stderr, err := client.CallAndLog(ctx, "Plugin.SayHi", name, &result)
 
-	log.Print(client.StdError())
+	log.Print(stderr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Println("Plugin.SayHi", name, "Returned:", result)
 	name = "bob"
-	err = client.Call("Plugin.SayHi", name, &result)
+	stderr, err = client.CallAndLog(ctx, "Plugin.SayHi", name, &result)
 
-	log.Print(client.StdError())
+	log.Print(stderr)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -41,9 +43,9 @@ func main() {
 	log.Println("Plugin.SayHi", name, "Returned:", result)
 
 	// this should fail
-	err = client.Call("Plugin.SayHi2", name, &result)
+	stderr, err = client.CallAndLog(ctx, "Plugin.SayHi2", name, &result)
 
-	log.Print(client.StdError())
+	log.Print(stderr)
 	if err != nil {
 		log.Println("Error:", err)
 	} else {
@@ -0,0 +1,57 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// Exec runs `cmd` in the plugin container, next to the plugin, and returns
+// what it wrote to stdout and stderr along with its exit code; e.g. `ps` or
+// `cat` to look into a misbehaving plugin without the docker CLI. A command
+// that runs but fails is not an error: check `exitCode`. The command gets no
+// stdin, and its output is kept in memory, so it should be short.
+//
+func (d *Client) Exec(ctx context.Context, cmd []string) (stdout, stderr string, exitCode int, err error) {
+	return d.exec(ctx, docker.CreateExecOptions{Cmd: cmd}, nil)
+}
+
+// exec is Exec of `opts`, with `stdin`, if not nil, copied to the command's
+// stdin.
+func (d *Client) exec(ctx context.Context, opts docker.CreateExecOptions, stdin io.Reader) (stdout, stderr string, exitCode int, err error) {
+	if err := d.requireContainer(); err != nil {
+		return "", "", 0, err
+	}
+	opts.Container = d.ID
+	opts.AttachStdin = stdin != nil
+	opts.AttachStdout = true
+	opts.AttachStderr = true
+	opts.Context = ctx
+	exec, err := d.dockerClient.CreateExec(opts)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	var outBuf, errBuf bytes.Buffer
+	err = d.dockerClient.StartExec(exec.ID, docker.StartExecOptions{
+		InputStream:  stdin,
+		OutputStream: &outBuf,
+		ErrorStream:  &errBuf,
+		Context:      ctx,
+	})
+	if ctx.Err() != nil {
+		return outBuf.String(), errBuf.String(), 0, ctx.Err()
+	}
+	if err != nil {
+		return outBuf.String(), errBuf.String(), 0, err
+	}
+
+	inspect, err := d.dockerClient.InspectExec(exec.ID)
+	if err != nil {
+		return outBuf.String(), errBuf.String(), 0, err
+	}
+	return outBuf.String(), errBuf.String(), inspect.ExitCode, nil
+}
@@ -0,0 +1,68 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name           string
+		stdout, stderr string
+		code           int
+	}{
+		{"output", "PID CMD\n1 plugin\n", "warning\n", 0},
+		{"exit code", "", "cat: x: No such file\n", 1},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		daemon.exec = func(cmd []string, stdin []byte) (string, string, int) {
+			return test.stdout, test.stderr, test.code
+		}
+		d := attachedClient(t, daemon, nil)
+
+		stdout, stderr, code, err := d.Exec(context.Background(), []string{"ps"})
+		if err != nil {
+			t.Errorf("%s: Exec returned %v", test.name, err)
+		}
+		if stdout != test.stdout || stderr != test.stderr || code != test.code {
+			t.Errorf("%s: Exec = %q, %q, %d; want %q, %q, %d", test.name,
+				stdout, stderr, code, test.stdout, test.stderr, test.code)
+		}
+
+		create := daemon.requestsTo("POST", "/containers/plugin/exec")
+		if len(create) != 1 {
+			t.Fatalf("%s: created %d execs", test.name, len(create))
+		}
+		var opts docker.CreateExecOptions
+		b, _ := io.ReadAll(create[0].Body)
+		json.Unmarshal(b, &opts)
+		if !reflect.DeepEqual(opts.Cmd, []string{"ps"}) || !opts.AttachStdout || !opts.AttachStderr || opts.AttachStdin {
+			t.Errorf("%s: created the exec with %s", test.name, b)
+		}
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	if _, _, _, err := d.Exec(context.Background(), []string{"ps"}); err != errNotStarted {
+		t.Errorf("Exec before Start = %v, want %v", err, errNotStarted)
+	}
+
+	daemon := newTestDaemon(t)
+	daemon.route("POST /containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 409, map[string]string{"message": "container is not running"})
+	})
+	d = attachedClient(t, daemon, nil)
+	_, _, _, err := d.Exec(context.Background(), []string{"ps"})
+	if err == nil || !strings.Contains(err.Error(), "container is not running") {
+		t.Errorf("Exec in a stopped container = %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package dockerpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+)
+
+// newGobClient returns a Client from NewConnClient with a gob codec, and a
+// plugin serving gob.
+func newGobClient(t *testing.T) *Client {
+	client, plugin := net.Pipe()
+	go func() {
+		var mutex sync.Mutex
+		stdout := &frames{mutex: &mutex, w: plugin, stream: STDOUT}
+		stderr := &frames{mutex: &mutex, w: plugin, stream: STDERR}
+
+		s := rpc.NewServer()
+		s.RegisterName("Echo", &testEcho{stderr: stderr})
+		s.ServeConn(&struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{plugin, stdout, plugin})
+	}()
+
+	d := NewConnClient(client, newGobClientCodec)
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestNewConnClientFactory(t *testing.T) {
+	d := newGobClient(t)
+
+	var reply string
+	if err := d.Call("Echo.Echo", "gob", &reply); err != nil || reply != "gob" {
+		t.Fatalf("Call = %q, %v", reply, err)
+	}
+	if d.StdError() != "echo: gob\n" {
+		t.Errorf("StdError = %q", d.StdError())
+	}
+	if err := d.Call("Echo.Fail", "boom", &reply); err != rpc.ServerError("boom") {
+		t.Errorf("failing Call = %v", err)
+	}
+
+	if _, err := d.CallStream(context.Background(), "Echo.Count", 1); err != errNeedsCodec {
+		t.Errorf("CallStream = %v, want %v", err, errNeedsCodec)
+	}
+	calls := []BatchCall{{Method: "Echo.Echo", Args: "x", Reply: &reply}}
+	if err := d.CallBatch(context.Background(), calls); err != errNeedsCodec {
+		t.Errorf("CallBatch = %v, want %v", err, errNeedsCodec)
+	}
+	if err := d.Reconnect(context.Background()); err == nil {
+		t.Error("Reconnect succeeded with a factory codec")
+	}
+}
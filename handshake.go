@@ -0,0 +1,256 @@
+package dockerpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// ProtocolVersion is the dockerpc protocol version spoken by this package.
+//
+// The handshake wire format is a single line in each direction, sent before
+// any JSON-RPC traffic:
+//
+//	client -> plugin stdin:  "DOCKERPC <version>\n"
+//	plugin stdout -> client: "DOCKERPC <version>\n"
+//
+// Both sides fail if the versions differ.
+//
+const ProtocolVersion = 1
+
+const handshakeMagic = "DOCKERPC"
+
+// the handshake line is tiny; anything longer is not a handshake.
+const maxHandshakeLine = 64
+
+// how long Start waits for the plugin to answer the handshake.
+var defaultHandshakeTimeout = 10 * time.Second
+
+// how long Start waits for the ready line, see ReadyLine.
+var defaultReadyTimeout = 10 * time.Second
+
+func writeHandshake(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", handshakeMagic, ProtocolVersion)
+	return err
+}
+
+//
+// readHandshake reads a handshake line and returns the peer's version. It
+// reads a byte at a time so nothing after the line is consumed. Zero length
+// reads (stderr frames, on the client side) are skipped.
+//
+func readHandshake(r io.Reader) (int, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			if len(line) > maxHandshakeLine {
+				return 0, errors.New("dockerpc: invalid handshake: line too long")
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("dockerpc: reading handshake: %s", err)
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) != 2 || fields[0] != handshakeMagic {
+		return 0, fmt.Errorf("dockerpc: invalid handshake: %q", line)
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("dockerpc: invalid handshake version: %q", fields[1])
+	}
+	return version, nil
+}
+
+// incompatible checks the peer's protocol version against ours.
+func incompatible(peer int) error {
+	if peer != ProtocolVersion {
+		return fmt.Errorf("dockerpc: incompatible plugin protocol version %d, this client speaks %d", peer, ProtocolVersion)
+	}
+	return nil
+}
+
+//
+// ServeHandshake answers the handshake of a client that has Handshake set.
+// Plugins call it on their stdin/stdout before serving RPC:
+//
+//	if err := dockerpc.ServeHandshake(dockerpc.Stdio()); err != nil {
+//		log.Fatal(err)
+//	}
+//	p.ServeCodec(jsonrpc.NewServerCodec)
+//
+// The plugin always replies with its own version, so the client can report
+// the mismatch; an error is returned if the versions are incompatible.
+//
+func ServeHandshake(rw io.ReadWriter) error {
+	version, err := readHandshake(rw)
+	if err != nil {
+		return err
+	}
+	if err := writeHandshake(rw); err != nil {
+		return err
+	}
+	return incompatible(version)
+}
+
+//
+// handshake performs the client side of the handshake over the attached
+// streams, bounded by HandshakeTimeout.
+//
+func (d *Client) handshake(conn net.Conn, pipes *dockerPipes) error {
+	timeout := d.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultHandshakeTimeout
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeHandshake(pipes); err != nil {
+		return err
+	}
+	var r io.Reader = pipes
+	if d.FatalPattern != nil {
+		watch := d.watchStartup(pipes)
+		defer watch.stop()
+		r = watchedReader{pipes, watch}
+	}
+	version, err := readHandshake(r)
+	if err != nil {
+		return err
+	}
+	return incompatible(version)
+}
+
+//
+// WriteReady writes `line` to stderr, for a client that waits for it with
+// ReadyLine. Plugins call it once they can serve, before serving RPC:
+//
+//	dockerpc.WriteReady("plugin ready")
+//	p.ServeCodec(jsonrpc.NewServerCodec)
+//
+// The sentinel is a line of its own on stderr; anything else the plugin
+// logs there before it is fine, but it must not write to stdout until then.
+//
+func WriteReady(line string) error {
+	_, err := fmt.Fprintln(os.Stderr, line)
+	return err
+}
+
+//
+// waitReady reads the attached streams until the plugin writes ReadyLine to
+// stderr, bounded by ReadyTimeout. The stderr lines still reach the line
+// handler and buffer, if they are kept.
+//
+func (d *Client) waitReady(conn net.Conn, pipes *dockerPipes, stderr bool) error {
+	if !stderr || d.tty {
+		return errors.New("dockerpc: ReadyLine needs the plugin's stderr attached, without a TTY")
+	}
+	timeout := d.ReadyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	watch := d.watchStartup(pipes)
+	defer watch.stop()
+
+	b := make([]byte, 512)
+	for !watch.ready {
+		n, err := pipes.Read(b)
+		if err := watch.err(); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("dockerpc: plugin wrote to stdout before the ready line %q", d.ReadyLine)
+		}
+		if err != nil {
+			return fmt.Errorf("dockerpc: waiting for the ready line %q: %s", d.ReadyLine, err)
+		}
+	}
+	return nil
+}
+
+//
+// startupWatch follows the plugin's stderr lines while Start waits for it
+// to be ready, for the ReadyLine and lines matching FatalPattern. The lines
+// still reach the line handler and buffer, if they are kept.
+//
+type startupWatch struct {
+	pipes   *dockerPipes
+	handler func(line string) // the one watchStartup replaced
+	ready   bool              // ReadyLine was seen
+	fatal   string            // the first line matching FatalPattern
+}
+
+//
+// watchStartup starts watching the stderr of `pipes`, whose reads then
+// also return after stderr frames (as empty reads), so that the watch is
+// checked as lines arrive.
+//
+func (d *Client) watchStartup(pipes *dockerPipes) *startupWatch {
+	w := &startupWatch{pipes: pipes, handler: pipes.stdErrLine}
+	pipes.stdErrLine = func(line string) {
+		if w.handler != nil {
+			w.handler(line)
+		}
+		if d.ReadyLine != "" && line == d.ReadyLine {
+			w.ready = true
+		}
+		if d.FatalPattern != nil && w.fatal == "" && d.FatalPattern.MatchString(line) {
+			w.fatal = line
+		}
+	}
+	pipes.stderrReads = true
+	return w
+}
+
+// err returns the error of a plugin that logged a fatal line.
+func (w *startupWatch) err() error {
+	if w.fatal == "" {
+		return nil
+	}
+	return fmt.Errorf("dockerpc: plugin failed to start: %s", w.fatal)
+}
+
+// stop ends the watch, and restores the line handler.
+func (w *startupWatch) stop() {
+	pipes := w.pipes
+	pipes.stdErrLine = w.handler
+	pipes.stderrReads = false
+	if w.handler == nil {
+		pipes.lineMutex.Lock()
+		pipes.partialLine = nil
+		pipes.lineMutex.Unlock()
+	}
+}
+
+// watchedReader fails the reads of the handshake once the plugin logged a
+// fatal line.
+type watchedReader struct {
+	r     io.Reader
+	watch *startupWatch
+}
+
+func (r watchedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if fatal := r.watch.err(); fatal != nil {
+		return n, fatal
+	}
+	return n, err
+}
@@ -0,0 +1,218 @@
+package dockerpc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string // the plugin's handshake line; "" to serve a real one
+		err   string // "" for success
+	}{
+		{"compatible", "", ""},
+		{"other version", "DOCKERPC 2\n", "incompatible plugin protocol version 2"},
+		{"not a handshake", `{"id":1}` + "\n", "invalid handshake"},
+		{"silent", "-", "reading handshake"},
+	}
+	for _, test := range tests {
+		client, plugin := net.Pipe()
+		go func() {
+			defer plugin.Close()
+			var mutex sync.Mutex
+			stdout := &frames{mutex: &mutex, w: plugin, stream: STDOUT}
+			switch test.reply {
+			case "":
+				if err := ServeHandshake(struct {
+					io.Reader
+					io.Writer
+				}{plugin, stdout}); err != nil {
+					return
+				}
+				servePlugin(plugin, plugin, plugin)
+			case "-":
+				io.Copy(io.Discard, plugin)
+			default:
+				readHandshake(plugin)
+				io.WriteString(stdout, test.reply)
+				io.Copy(io.Discard, plugin)
+			}
+		}()
+
+		d := &Client{clientConn: client, CaptureStderr: true, Handshake: true, HandshakeTimeout: 50 * time.Millisecond}
+		err := d.startRPC(true)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			var reply string
+			if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+				t.Errorf("%s: Call after the handshake = %q, %v", test.name, reply, err)
+			}
+			d.Close()
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: handshake = %v, want an error with %q", test.name, err, test.err)
+		}
+		client.Close()
+	}
+}
+
+func TestReadyLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		output []testFrame // what the plugin writes, after a delay
+		err    string      // "" for success
+	}{
+		{"ready", []testFrame{{STDERR, "starting\n"}, {STDERR, "plug"}, {STDERR, "in ready\nserving\n"}}, ""},
+		{"stdout first", []testFrame{{STDOUT, "{}\n"}, {STDERR, "plugin ready\n"}}, "stdout before the ready line"},
+		{"never ready", []testFrame{{STDERR, "plugin ready soon\n"}}, "waiting for the ready line"},
+	}
+	for _, test := range tests {
+		client, plugin := net.Pipe()
+		go func() {
+			defer plugin.Close()
+			time.Sleep(50 * time.Millisecond)
+			for _, f := range test.output {
+				writeFrame(plugin, f.stream, []byte(f.payload))
+			}
+			servePlugin(plugin, plugin, plugin)
+		}()
+
+		var lines lineRecorder
+		d := &Client{clientConn: client, CaptureStderr: true, ReadyLine: "plugin ready", ReadyTimeout: 500 * time.Millisecond}
+		d.SetStdErrLineHandler(lines.add)
+		start := time.Now()
+		err := d.startRPC(true)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: startRPC = %v, want an error with %q", test.name, err, test.err)
+			}
+			client.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("%s: startRPC returned after %s, before the ready line", test.name, elapsed)
+		}
+		var reply string
+		if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+			t.Errorf("%s: Call after the ready line = %q, %v", test.name, reply, err)
+		}
+		want := []string{"starting", "plugin ready", "serving", "echo: hi"}
+		if got := lines.get(); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: got stderr lines %q, want %q", test.name, got, want)
+		}
+		d.Close()
+	}
+}
+
+func TestReadyLineNeedsStderr(t *testing.T) {
+	client, plugin := net.Pipe()
+	defer plugin.Close()
+	d := &Client{clientConn: client, ReadyLine: "plugin ready"}
+	if err := d.startRPC(false); err == nil {
+		t.Error("waited for a ready line without stderr")
+	}
+}
+
+func TestFatalPattern(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake bool
+	}{
+		{"ready line", false},
+		{"handshake", true},
+	}
+	for _, test := range tests {
+		client, plugin := net.Pipe()
+		go func() {
+			// the plugin logs its failure, but does not exit.
+			go io.Copy(io.Discard, plugin)
+			writeFrame(plugin, STDERR, []byte("starting\nFATAL: no config at /etc/plugin.conf\n"))
+		}()
+
+		var lines lineRecorder
+		d := &Client{
+			clientConn:       client,
+			CaptureStderr:    true,
+			FatalPattern:     regexp.MustCompile(`^FATAL`),
+			HandshakeTimeout: 5 * time.Second,
+			ReadyTimeout:     5 * time.Second,
+		}
+		if test.handshake {
+			d.Handshake = true
+		} else {
+			d.ReadyLine = "plugin ready"
+		}
+		d.SetStdErrLineHandler(lines.add)
+
+		start := time.Now()
+		err := d.startRPC(true)
+		if err == nil || !strings.Contains(err.Error(), "FATAL: no config at /etc/plugin.conf") {
+			t.Errorf("%s: startRPC = %v, want the fatal line", test.name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: startRPC took %s to fail", test.name, elapsed)
+		}
+		if got := lines.get(); len(got) != 2 {
+			t.Errorf("%s: got stderr lines %q", test.name, got)
+		}
+		client.Close()
+		plugin.Close()
+	}
+}
+
+func TestStartupLinesBeforeAttach(t *testing.T) {
+	// the plugin wrote the ready line before Start attached: only a replay
+	// of its logs has it.
+	var ready bytes.Buffer
+	writeFrame(&ready, STDERR, []byte("starting\nplugin ready\n"))
+	daemon := newTestDaemon(t)
+	daemon.logs = ready.Bytes()
+	d := startedClient(t, daemon, func(d *Client) {
+		d.ReadyLine = "plugin ready"
+		d.ReadyTimeout = time.Second
+	})
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Errorf("Call after the ready line = %q, %v", reply, err)
+	}
+	if query := daemon.requestsTo("POST", "/containers/plugin/attach")[0].URL.Query(); query.Get("logs") != "1" {
+		t.Errorf("attached with %s, without logs", query.Encode())
+	}
+	if d.attachOpts.Logs {
+		t.Error("Reconnect would replay the logs")
+	}
+
+	// nor a fatal line.
+	var fatal bytes.Buffer
+	writeFrame(&fatal, STDERR, []byte("FATAL: no config at /etc/plugin.conf\n"))
+	daemon = newTestDaemon(t)
+	daemon.logs = fatal.Bytes()
+	d = NewClient("", "image", daemon.endpoint())
+	d.Handshake = true
+	d.HandshakeTimeout = 5 * time.Second
+	d.FatalPattern = regexp.MustCompile(`^FATAL`)
+	defer d.Close()
+	start := time.Now()
+	err := d.Start()
+	if err == nil || !strings.Contains(err.Error(), "FATAL: no config at /etc/plugin.conf") {
+		t.Errorf("Start = %v, want the fatal line", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Start took %s to fail", elapsed)
+	}
+}
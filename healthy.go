@@ -0,0 +1,93 @@
+package dockerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+//
+// StartAndWaitHealthy starts the plugin and returns once it is fully usable:
+// the container is started as by StartContext, the plugin's RPC server has
+// answered a ping, and, if the image has a healthcheck, Docker reports the
+// container healthy. It fails if the plugin exits, the healthcheck reports
+// it unhealthy, or `ctx` is done first (the health polls, as described on
+// PollInterval, also give up after PollTimeout if set).
+//
+// On any failure the Client is closed, which removes the container as Close
+// does (see CloseMode and KeepOnError).
+//
+func (d *Client) StartAndWaitHealthy(ctx context.Context) error {
+	_, err := d.StartContext(ctx)
+	if err == nil {
+		err = d.waitUsable(ctx)
+	}
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return nil
+}
+
+// waitUsable pings the started plugin, then waits for its healthcheck.
+func (d *Client) waitUsable(ctx context.Context) error {
+	if err := d.ping(ctx); err != nil {
+		return err
+	}
+	return d.waitHealthy(ctx)
+}
+
+//
+// ping makes a call the plugin's RPC server answers whatever it serves: a
+// Server lists its methods, others fail with their unknown method error.
+// Either way, the server is up.
+//
+func (d *Client) ping(ctx context.Context) error {
+	err := d.CallContext(ctx, methodsMethod, nil, nil)
+	var serverErr rpc.ServerError
+	var rpcErr *RPCError
+	if err == nil || errors.As(err, &serverErr) || errors.As(err, &rpcErr) {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("dockerpc: plugin did not answer a ping: %s", err)
+}
+
+//
+// waitHealthy polls the container until its healthcheck passes. A container
+// without a healthcheck is healthy once it runs.
+//
+func (d *Client) waitHealthy(ctx context.Context) error {
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+	return d.poll(ctx, func() (bool, error) {
+		c, err := d.dockerClient.InspectContainerWithContext(d.ID, ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return false, err
+		}
+		if !c.State.Running {
+			return false, fmt.Errorf("dockerpc: container %s exited with code %d before it was healthy", d.ID, c.State.ExitCode)
+		}
+
+		health := c.State.Health
+		switch health.Status {
+		case "", "healthy":
+			return true, nil
+		case "unhealthy":
+			var output string
+			if n := len(health.Log); n > 0 {
+				output = strings.TrimSpace(health.Log[n-1].Output)
+			}
+			return false, fmt.Errorf("dockerpc: container %s is unhealthy after %d failed checks: %s", d.ID, health.FailingStreak, output)
+		}
+		return false, nil // "starting"
+	})
+}
@@ -0,0 +1,156 @@
+package dockerpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// inspectStates makes `daemon` inspect its container with `states` in
+// turn, then the last one again, and returns the number of inspects.
+func inspectStates(daemon *testDaemon, states []docker.State) func() int {
+	var mutex sync.Mutex
+	inspects := 0
+	daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		c := testContainer()
+		c.State = states[len(states)-1]
+		if inspects < len(states) {
+			c.State = states[inspects]
+		}
+		inspects++
+		writeJSON(w, 200, c)
+	})
+	return func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return inspects
+	}
+}
+
+// healthClient returns a Client in an RPC session with the test plugin
+// through `daemon`, polling quickly.
+func healthClient(t *testing.T, daemon *testDaemon) *Client {
+	d := attachedClient(t, daemon, func(d *Client) {
+		d.PollInterval = time.Millisecond
+	})
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func healthState(status string) docker.State {
+	return docker.State{Running: true, Health: docker.Health{Status: status}}
+}
+
+func TestWaitUsable(t *testing.T) {
+	unhealthy := healthState("unhealthy")
+	unhealthy.Health.FailingStreak = 3
+	unhealthy.Health.Log = []docker.HealthCheck{{ExitCode: 1, Output: "connection refused\n"}}
+
+	tests := []struct {
+		name     string
+		states   []docker.State
+		inspects int
+		err      string // "" for none
+	}{
+		{"no healthcheck", []docker.State{{Running: true}}, 1, ""},
+		{"healthy", []docker.State{healthState("starting"), healthState("starting"), healthState("healthy")}, 3, ""},
+		{"unhealthy", []docker.State{healthState("starting"), unhealthy}, 2,
+			"dockerpc: container plugin is unhealthy after 3 failed checks: connection refused"},
+		{"exited", []docker.State{healthState("starting"), {ExitCode: 2}}, 2,
+			"dockerpc: container plugin exited with code 2 before it was healthy"},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		inspects := inspectStates(daemon, test.states)
+		d := healthClient(t, daemon)
+
+		err := d.waitUsable(context.Background())
+		if got := errString(err); got != test.err {
+			t.Errorf("%s: waitUsable = %q, want %q", test.name, got, test.err)
+		}
+		if got := inspects(); got != test.inspects {
+			t.Errorf("%s: inspected %d times, want %d", test.name, got, test.inspects)
+		}
+	}
+}
+
+func TestWaitUsableTimeout(t *testing.T) {
+	daemon := newTestDaemon(t)
+	inspectStates(daemon, []docker.State{healthState("starting")})
+	d := healthClient(t, daemon)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.waitUsable(ctx); err != context.DeadlineExceeded {
+		t.Errorf("waitUsable = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPing(t *testing.T) {
+	// a Server answers with its methods.
+	d := newTestClient(t, nil)
+	if err := d.ping(context.Background()); err != nil {
+		t.Errorf("ping = %v", err)
+	}
+
+	// other plugins fail the call, which is an answer too.
+	for _, resp := range []string{
+		`{"jsonrpc":"2.0","id":%d,"error":"rpc: can't find service _dockerpc.Methods"}`,
+		`{"jsonrpc":"2.0","id":%d,"error":{"code":-32601,"message":"Method not found"}}`,
+	} {
+		d = newRawClient(t, map[string][]string{"_dockerpc.Methods": {resp}})
+		if err := d.ping(context.Background()); err != nil {
+			t.Errorf("ping answered with %s = %v", resp, err)
+		}
+	}
+
+	// a plugin that is gone does not answer.
+	d = newTestClient(t, nil)
+	d.rpcClient.Close()
+	if err := d.ping(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "dockerpc: plugin did not answer a ping") {
+		t.Errorf("ping of a closed session = %v", err)
+	}
+
+	// nor one that reads requests, but never answers.
+	client, plugin := net.Pipe()
+	defer plugin.Close()
+	go io.Copy(io.Discard, plugin)
+	d = NewConnClient(client, nil)
+	defer d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ping of a silent plugin = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStartAndWaitHealthyCloses(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	d.DockerAttachOptions = &docker.AttachToContainerOptions{Stdout: true}
+
+	if err := d.StartAndWaitHealthy(context.Background()); err == nil {
+		t.Fatal("StartAndWaitHealthy without stdin attached succeeded")
+	}
+	if !d.closed {
+		t.Error("the Client is still open after the failure")
+	}
+}
+
+// errString returns the message of `err`, or "" for nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
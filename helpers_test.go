@@ -0,0 +1,605 @@
+package dockerpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// testEcho is the service of the test plugin, registered as "Echo".
+type testEcho struct {
+	stderr io.Writer
+}
+
+func (e *testEcho) Echo(msg string, reply *string) error {
+	fmt.Fprintf(e.stderr, "echo: %s\n", msg)
+	*reply = msg
+	return nil
+}
+
+func (e *testEcho) Sleep(d time.Duration, reply *time.Duration) error {
+	time.Sleep(d)
+	*reply = d
+	return nil
+}
+
+// testPair is a struct argument for the test plugin.
+type testPair struct {
+	Key   string
+	Value int
+}
+
+// Swap replies with `p`, its value negated.
+func (e *testEcho) Swap(p testPair, reply *testPair) error {
+	*reply = testPair{Key: p.Key, Value: -p.Value}
+	return nil
+}
+
+func (e *testEcho) Panic(msg string, reply *string) error {
+	panic(msg)
+}
+
+func (e *testEcho) Fail(msg string, reply *string) error {
+	return errors.New(msg)
+}
+
+// Count streams 0 to n-1.
+func (e *testEcho) Count(n int, stream *Stream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountFail streams 0 to n-1, then fails.
+func (e *testEcho) CountFail(n int, stream *Stream) error {
+	e.Count(n, stream)
+	return errors.New("count failed")
+}
+
+// writeFrame writes `p` as one frame of `stream`, header and payload in a
+// single write, as the daemon does.
+func writeFrame(w io.Writer, stream byte, p []byte) error {
+	frame := make([]byte, 8+len(p))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(p)))
+	copy(frame[8:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// frames writes to one stream of an attach connection.
+type frames struct {
+	mutex  *sync.Mutex // shared by the streams of a connection
+	w      io.Writer
+	stream byte
+}
+
+func (f *frames) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := writeFrame(f.w, f.stream, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// servePlugin runs the test plugin, reading stdin from `in` and writing
+// framed stdout and stderr to `out`, until `in` is closed.
+func servePlugin(in io.Reader, out io.Writer, closer io.Closer) {
+	var mutex sync.Mutex
+	stdout := &frames{mutex: &mutex, w: out, stream: STDOUT}
+	stderr := &frames{mutex: &mutex, w: out, stream: STDERR}
+	serveStreams(in, stdout, stderr, closer)
+}
+
+// serveStreams runs the test plugin on `in`, `stdout` and `stderr`, until
+// `in` is closed.
+func serveStreams(in io.Reader, stdout, stderr io.Writer, closer io.Closer) {
+	s := NewServer()
+	s.PanicStack = true
+	s.RegisterName("Echo", &testEcho{stderr: stderr})
+	s.ServeConn(&struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{in, stdout, closer})
+}
+
+//
+// newTestClient returns a Client connected to the test plugin over an
+// in-memory connection. `configure`, if not nil, is called before the RPC
+// session starts.
+//
+func newTestClient(t *testing.T, configure func(d *Client)) *Client {
+	client, plugin := net.Pipe()
+	go servePlugin(plugin, plugin, plugin)
+
+	d := &Client{clientConn: client, CaptureStderr: true}
+	if configure != nil {
+		configure(d)
+	}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+//
+// testDaemon answers Docker API calls like the daemon, with the handler
+// routed for them, and attach requests, serving the test plugin over the
+// hijacked connections. The default routes run one container, "plugin";
+// requests without a route get a 404.
+//
+type testDaemon struct {
+	listener net.Listener
+	prefix   []byte // sent in the same write as the attach response
+	logs     []byte // framed output from before the attach, sent for logs=1
+	hangup   bool   // close attach connections right after the response
+	refuse   int    // attach requests to refuse, before the next is upgraded
+	tty      bool   // serve the plugin unframed, as for a container with a TTY
+
+	mutex    sync.Mutex
+	requests []*http.Request
+	conns    []net.Conn
+	output   chan net.Conn               // output-only attach, waiting for its stdin
+	routes   map[string]http.HandlerFunc // by http.ServeMux pattern
+	execs    map[string]*testExec        // by exec id
+	exec     func(cmd []string, stdin []byte) (stdout, stderr string, code int)
+
+	// process, if set, runs in place of the plugin, writing framed stdout.
+	process func(stdin io.Reader, stdout io.Writer)
+
+	// events and stats, if set, are streamed to the events and stats
+	// requests, until closed.
+	events chan docker.APIEvents
+	stats  chan docker.Stats
+}
+
+// testExec is an exec created on the test daemon.
+type testExec struct {
+	Cmd      []string
+	User     string
+	ExitCode int
+	Running  bool
+	started  bool
+	stdin    []byte
+}
+
+func newTestDaemon(t *testing.T) *testDaemon {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := &testDaemon{
+		listener: l,
+		output:   make(chan net.Conn, 1),
+		routes:   make(map[string]http.HandlerFunc),
+		execs:    make(map[string]*testExec),
+	}
+	daemon.defaultRoutes()
+	go daemon.serve()
+	t.Cleanup(daemon.close)
+	return daemon
+}
+
+func (daemon *testDaemon) endpoint() string {
+	return "tcp://" + daemon.listener.Addr().String()
+}
+
+//
+// route makes the daemon answer requests matching `pattern`, as given to
+// http.ServeMux, with `h`; in place of the route for the same pattern, if
+// any.
+//
+func (daemon *testDaemon) route(pattern string, h http.HandlerFunc) {
+	daemon.mutex.Lock()
+	daemon.routes[pattern] = h
+	daemon.mutex.Unlock()
+}
+
+// writeJSON answers a test daemon request with `v`.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// testContainer is how the test daemon's container "plugin" inspects.
+func testContainer() *docker.Container {
+	return &docker.Container{
+		ID:     "plugin",
+		Name:   "/plugin",
+		Config: &docker.Config{Image: "image", OpenStdin: true},
+		State:  docker.State{Running: true, Status: "running"},
+	}
+}
+
+func (daemon *testDaemon) defaultRoutes() {
+	daemon.route("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]string{"ApiVersion": "1.41", "Version": "20.10.0"})
+	})
+	daemon.route("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 201, map[string]string{"Id": "plugin"})
+	})
+	daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, testContainer())
+	})
+	for _, pattern := range []string{
+		"POST /containers/{id}/start",
+		"POST /containers/{id}/stop",
+		"POST /containers/{id}/kill",
+		"DELETE /containers/{id}",
+	} {
+		daemon.route(pattern, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		})
+	}
+	daemon.route("POST /containers/{id}/checkpoints", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+	})
+
+	daemon.route("POST /containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		var opts docker.CreateExecOptions
+		json.NewDecoder(r.Body).Decode(&opts)
+		daemon.mutex.Lock()
+		id := fmt.Sprintf("exec%d", len(daemon.execs)+1)
+		daemon.execs[id] = &testExec{Cmd: opts.Cmd, User: opts.User}
+		daemon.mutex.Unlock()
+		writeJSON(w, 201, map[string]string{"Id": id})
+	})
+	daemon.route("GET /exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		daemon.mutex.Lock()
+		exec, ok := daemon.execs[r.PathValue("id")]
+		var inspect docker.ExecInspect
+		if ok {
+			inspect = docker.ExecInspect{ID: r.PathValue("id"), ExitCode: exec.ExitCode, Running: exec.Running}
+		}
+		daemon.mutex.Unlock()
+		if !ok {
+			writeJSON(w, 404, map[string]string{"message": "no such exec"})
+			return
+		}
+		writeJSON(w, 200, inspect)
+	})
+}
+
+func (daemon *testDaemon) serve() {
+	for {
+		conn, err := daemon.listener.Accept()
+		if err != nil {
+			return
+		}
+		go daemon.handle(conn)
+	}
+}
+
+// apiVersionPrefix matches the version of a versioned API path, "/v1.41/".
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+func (daemon *testDaemon) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	// the daemon serves every API version the same, as far as the tests go.
+	req.URL.Path = apiVersionPrefix.ReplaceAllString(req.URL.Path, "/")
+	// keep the body readable for the test, after the handler read it.
+	body, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	daemon.mutex.Lock()
+	daemon.requests = append(daemon.requests, req)
+	daemon.conns = append(daemon.conns, conn)
+	prefix, hangup, tty := daemon.prefix, daemon.hangup, daemon.tty
+	refused := daemon.refuse > 0 && strings.HasSuffix(req.URL.Path, "/attach")
+	if refused {
+		daemon.refuse--
+	}
+	if req.URL.Query().Get("logs") == "1" {
+		prefix = append(append([]byte(nil), daemon.logs...), prefix...)
+	}
+	daemon.mutex.Unlock()
+
+	query := req.URL.Query()
+	switch {
+	case refused:
+		// as the daemon does for a container that is not running yet.
+		w := httptest.NewRecorder()
+		writeJSON(w, 409, map[string]string{"message": "container plugin is not running"})
+		resp := w.Result()
+		resp.ContentLength = int64(w.Body.Len())
+		resp.Write(conn)
+		conn.Close()
+		return
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/attach") && query.Get("stream") == "1":
+	case req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/exec/") && strings.HasSuffix(req.URL.Path, "/start"):
+		daemon.startExec(conn, r, strings.Split(req.URL.Path, "/")[2])
+		return
+	case req.Method == "GET" && req.URL.Path == "/events" && daemon.events != nil:
+		daemon.streamEvents(conn)
+		return
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/stats") && daemon.stats != nil:
+		daemon.streamStats(conn)
+		return
+	default:
+		daemon.answer(conn, req, body)
+		return
+	}
+
+	response := "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"
+	conn.Write(append([]byte(response), prefix...))
+	if hangup {
+		conn.Close()
+		return
+	}
+
+	stdin, stdout := query.Get("stdin") == "1", query.Get("stdout") == "1"
+	switch {
+	case stdin && stdout && tty:
+		// a TTY would mix stderr into the RPC output; a plugin run on one
+		// must log elsewhere.
+		serveStreams(r, conn, io.Discard, conn)
+	case stdin && stdout && daemon.process != nil:
+		daemon.process(r, &frames{mutex: new(sync.Mutex), w: conn, stream: STDOUT})
+		conn.Close()
+	case stdin && stdout:
+		servePlugin(r, conn, conn)
+	case stdout:
+		daemon.output <- conn
+	case stdin:
+		out := <-daemon.output
+		servePlugin(r, out, conn)
+		out.Close()
+	}
+}
+
+// answer answers an API call with its route, and closes the connection.
+func (daemon *testDaemon) answer(conn net.Conn, req *http.Request, body []byte) {
+	defer conn.Close()
+
+	mux := http.NewServeMux()
+	daemon.mutex.Lock()
+	for pattern, h := range daemon.routes {
+		mux.HandleFunc(pattern, h)
+	}
+	daemon.mutex.Unlock()
+
+	r := req.Clone(context.Background())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	resp := w.Result()
+	resp.Close = true
+	resp.Write(conn)
+}
+
+//
+// startExec runs exec `id` on a hijacked connection: its command gets what
+// the client writes until it closes its side, and its output is written in
+// frames, by the daemon's exec function.
+//
+func (daemon *testDaemon) startExec(conn net.Conn, r *bufio.Reader, id string) {
+	defer conn.Close()
+
+	daemon.mutex.Lock()
+	exec, ok := daemon.execs[id]
+	run := daemon.exec
+	daemon.mutex.Unlock()
+	if !ok {
+		io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+
+	stdin, _ := io.ReadAll(r)
+	var stdout, stderr string
+	var code int
+	if run != nil {
+		stdout, stderr, code = run(exec.Cmd, stdin)
+	}
+	if stdout != "" {
+		writeFrame(conn, STDOUT, []byte(stdout))
+	}
+	if stderr != "" {
+		writeFrame(conn, STDERR, []byte(stderr))
+	}
+
+	daemon.mutex.Lock()
+	exec.ExitCode = code
+	exec.started = true
+	exec.stdin = stdin
+	daemon.mutex.Unlock()
+}
+
+// streamEvents writes the daemon's events, as they come, until the client
+// goes away.
+func (daemon *testDaemon) streamEvents(conn net.Conn) {
+	defer conn.Close()
+	w := chunked(conn)
+	defer w.Close()
+	enc := json.NewEncoder(w)
+	for event := range daemon.events {
+		if err := enc.Encode(event); err != nil {
+			return
+		}
+	}
+}
+
+// streamStats is streamEvents for the container's stats.
+func (daemon *testDaemon) streamStats(conn net.Conn) {
+	defer conn.Close()
+	w := chunked(conn)
+	defer w.Close()
+	enc := json.NewEncoder(w)
+	for stats := range daemon.stats {
+		if err := enc.Encode(stats); err != nil {
+			return
+		}
+	}
+}
+
+//
+// chunked starts a streamed response on `conn`, whose body is written to the
+// writer returned, and ended when it is closed. It is chunked, as the
+// daemon's are: the client takes a body that ends with the connection for a
+// failed request.
+//
+func chunked(conn net.Conn) io.WriteCloser {
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n")
+	return chunkedBody{httputil.NewChunkedWriter(conn), conn}
+}
+
+// chunkedBody ends its chunks with the blank line after the (no) trailers.
+type chunkedBody struct {
+	io.WriteCloser
+	conn net.Conn
+}
+
+func (b chunkedBody) Close() error {
+	if err := b.WriteCloser.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(b.conn, "\r\n")
+	return err
+}
+
+// execCmds returns the commands of the execs started on the daemon.
+func (daemon *testDaemon) execCmds() [][]string {
+	var cmds [][]string
+	for _, exec := range daemon.startedExecs() {
+		cmds = append(cmds, exec.Cmd)
+	}
+	return cmds
+}
+
+// startedExecs returns the execs started on the daemon, in order.
+func (daemon *testDaemon) startedExecs() []testExec {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	var execs []testExec
+	for i := 1; i <= len(daemon.execs); i++ {
+		if exec := daemon.execs[fmt.Sprintf("exec%d", i)]; exec.started {
+			execs = append(execs, *exec)
+		}
+	}
+	return execs
+}
+
+// requestsTo returns the requests the daemon received as "METHOD /path".
+func (daemon *testDaemon) requestsTo(method, path string) []*http.Request {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	var reqs []*http.Request
+	for _, req := range daemon.requests {
+		if req.Method == method && req.URL.Path == path {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+//
+// startedClient returns a Client started on `daemon`, with `configure`, if
+// not nil, called before Start.
+//
+func startedClient(t *testing.T, daemon *testDaemon, configure func(d *Client)) *Client {
+	d := NewClient("", "image", daemon.endpoint())
+	if configure != nil {
+		configure(d)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// lastRequest returns the last request the daemon received.
+func (daemon *testDaemon) lastRequest() *http.Request {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	return daemon.requests[len(daemon.requests)-1]
+}
+
+// dropConns closes the attach connections made so far.
+func (daemon *testDaemon) dropConns() {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	for _, conn := range daemon.conns {
+		conn.Close()
+	}
+	daemon.conns = nil
+}
+
+func (daemon *testDaemon) close() {
+	daemon.listener.Close()
+	daemon.dropConns()
+}
+
+// testAttachOptions are the attach options for the test daemon's plugin.
+var testAttachOptions = docker.AttachToContainerOptions{
+	Container: "plugin",
+	Stream:    true,
+	Stdin:     true,
+	Stdout:    true,
+	Stderr:    true,
+}
+
+//
+// attachedClient returns a Client attached through `daemon` as if it had
+// started a container, but with no RPC session yet. `configure`, if not
+// nil, is called before the attach, and may change d.attachOpts. Close
+// leaves the (imaginary) container alone.
+//
+func attachedClient(t *testing.T, daemon *testDaemon, configure func(d *Client)) *Client {
+	d := NewClient("", "plugin", daemon.endpoint())
+	d.RemoveOnClose = false
+	d.ID = "plugin"
+	d.attachOpts = testAttachOptions
+	if configure != nil {
+		configure(d)
+	}
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := d.attach(context.Background(), d.attachOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.clientConn = conn
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// newAttachedClient is like attachedClient, with the RPC session started.
+func newAttachedClient(t *testing.T, daemon *testDaemon, configure func(d *Client)) *Client {
+	d := attachedClient(t, daemon, configure)
+	if err := d.startRPC(d.attachOpts.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
@@ -0,0 +1,76 @@
+package dockerpc
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// CallRecord describes a finished call, see CallHistorySize. BytesIn and
+// BytesOut are what crossed the attach stream while the call ran, as counted
+// by Stats; they include the traffic of any calls running at the same time.
+//
+type CallRecord struct {
+	Method   string
+	Start    time.Time
+	Duration time.Duration
+	Error    error
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// callHistory is a ring of the most recent CallRecords.
+type callHistory struct {
+	mutex   sync.Mutex
+	records []CallRecord
+	next    int // where the next record goes, once records is full
+}
+
+func (h *callHistory) add(size int, record CallRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.records) < size {
+		h.records = append(h.records, record)
+		return
+	}
+	h.records[h.next%len(h.records)] = record
+	h.next = (h.next + 1) % len(h.records)
+}
+
+//
+// CallHistory returns the most recent calls made with Call, CallContext or
+// CallAndLog, oldest first; at most CallHistorySize of them.
+//
+func (d *Client) CallHistory() []CallRecord {
+	h := &d.history
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	records := make([]CallRecord, 0, len(h.records))
+	records = append(records, h.records[h.next:]...)
+	return append(records, h.records[:h.next]...)
+}
+
+//
+// trackCall starts the history record of a call to `method`; the returned
+// function completes it with the call's error. Use as
+//
+//	defer d.trackCall(method)(&err)
+//
+func (d *Client) trackCall(method string) func(err *error) {
+	if d.CallHistorySize <= 0 {
+		return func(err *error) {}
+	}
+	start := time.Now()
+	in, out := d.Stats()
+	return func(err *error) {
+		in2, out2 := d.Stats()
+		d.history.add(d.CallHistorySize, CallRecord{
+			Method:   method,
+			Start:    start,
+			Duration: time.Since(start),
+			Error:    *err,
+			BytesIn:  in2 - in,
+			BytesOut: out2 - out,
+		})
+	}
+}
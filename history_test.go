@@ -0,0 +1,62 @@
+package dockerpc
+
+import (
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+func TestCallHistory(t *testing.T) {
+	tests := []struct {
+		size  int
+		calls int
+		want  []int // the recorded calls, oldest first
+	}{
+		{0, 3, nil},
+		{5, 3, []int{0, 1, 2}},
+		{3, 3, []int{0, 1, 2}},
+		{3, 4, []int{1, 2, 3}},
+		{3, 8, []int{5, 6, 7}},
+		{1, 2, []int{1}},
+	}
+	// call i sends i+1 bytes of argument, which tells the records apart.
+	request := len(`{"method":"Echo.Echo","params":[""],"id":1}` + "\n")
+
+	for _, test := range tests {
+		d := newTestClient(t, func(d *Client) {
+			d.CallHistorySize = test.size
+		})
+		var reply string
+		for i := 0; i < test.calls; i++ {
+			d.Call("Echo.Echo", strings.Repeat("x", i+1), &reply)
+		}
+
+		history := d.CallHistory()
+		if len(history) != len(test.want) {
+			t.Errorf("size %d after %d calls: %d records, want %d", test.size, test.calls, len(history), len(test.want))
+			continue
+		}
+		for i, r := range history {
+			out := uint64(request + test.want[i] + 1)
+			if r.Method != "Echo.Echo" || r.Error != nil || r.BytesOut != out || r.BytesIn == 0 {
+				t.Errorf("size %d after %d calls: record %d = %+v, want call %d", test.size, test.calls, i, r, test.want[i])
+			}
+			if i > 0 && r.Start.Before(history[i-1].Start) {
+				t.Errorf("size %d after %d calls: records out of order", test.size, test.calls)
+			}
+		}
+	}
+}
+
+func TestCallHistoryRecordsErrors(t *testing.T) {
+	d := newTestClient(t, func(d *Client) {
+		d.CallHistorySize = 2
+	})
+	var reply string
+	d.Call("Echo.Fail", "boom", &reply)
+
+	history := d.CallHistory()
+	if len(history) != 1 || history[0].Method != "Echo.Fail" || history[0].Error != rpc.ServerError("boom") {
+		t.Errorf("history = %+v", history)
+	}
+}
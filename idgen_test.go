@@ -0,0 +1,96 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestIDGenerator(t *testing.T) {
+	var log bytes.Buffer
+	d := newTestClient(t, func(d *Client) {
+		d.SetWireLog(&log)
+		d.IDGenerator = func(seq uint64) interface{} {
+			return fmt.Sprintf("job-7/%d", seq)
+		}
+	})
+
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	var one, two string
+	calls := []BatchCall{
+		{Method: "Echo.Echo", Args: "one", Reply: &one},
+		{Method: "Echo.Echo", Args: "two", Reply: &two},
+	}
+	if err := d.CallBatch(context.Background(), calls); err != nil || one != "one" || two != "two" {
+		t.Fatalf("batch = %q, %q, %v", one, two, err)
+	}
+	stream, err := d.CallStream(context.Background(), "Echo.Count", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range stream.C {
+		n++
+	}
+	if n != 2 || stream.Err() != nil {
+		t.Fatalf("streamed %d values, %v", n, stream.Err())
+	}
+	d.Close()
+
+	var requests, responses []string
+	for _, record := range readWireLog(t, log.Bytes()) {
+		if record.direction == '>' {
+			requests = append(requests, record.msg)
+		} else {
+			responses = append(responses, record.msg)
+		}
+	}
+	for i, msg := range requests {
+		id := fmt.Sprintf(`"id":"job-7/%d"`, i+1)
+		if !strings.Contains(msg, id) {
+			t.Errorf("request %s, want %s", msg, id)
+		}
+	}
+	for _, msg := range responses {
+		if !strings.Contains(msg, `"id":"job-7/`) {
+			t.Errorf("response %s, want a generated id", msg)
+		}
+	}
+	if len(requests) != 4 {
+		t.Errorf("sent %d requests, want 4", len(requests))
+	}
+}
+
+func TestIDGeneratorErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		gen  func(seq uint64) interface{}
+		want string
+	}{
+		{"duplicate", func(seq uint64) interface{} { return "same" }, `dockerpc: IDGenerator returned id "same", already in flight`},
+		{"not JSON", func(seq uint64) interface{} { return func() {} }, "dockerpc: IDGenerator: json: unsupported type: func()"},
+	}
+	for _, test := range tests {
+		codec := newClientCodec(nopConn{})
+		codec.newID = test.gen
+		codec.send("Echo.Sleep", 0, func(resp *clientResponse, err error) bool { return true })
+
+		_, err := codec.send("Echo.Sleep", 0, func(resp *clientResponse, err error) bool { return true })
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: send = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+// nopConn discards what is written to it, and has nothing to read.
+type nopConn struct{}
+
+func (nopConn) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (nopConn) Write(b []byte) (int, error) { return len(b), nil }
+func (nopConn) Close() error                { return nil }
@@ -0,0 +1,143 @@
+package dockerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// BuildImage builds the plugin image from a Dockerfile, tags it `opts.Name`,
+// and makes Start run it in place of the image given to NewClient. The build
+// context comes from `opts.InputStream` (a tar) or `opts.ContextDir`, and the
+// build output is streamed to `opts.OutputStream` if set.
+//
+func (d *Client) BuildImage(ctx context.Context, opts docker.BuildImageOptions) error {
+	if opts.Name == "" {
+		return errors.New("dockerpc: BuildImage needs a Name to tag the image with")
+	}
+	if err := d.connect(); err != nil {
+		return err
+	}
+
+	opts.Context = ctx
+	if opts.Platform == "" {
+		opts.Platform = d.platform
+	}
+	if opts.OutputStream == nil {
+		// the docker client insists on one.
+		opts.OutputStream = io.Discard
+	}
+
+	if err := d.dockerClient.BuildImage(opts); err != nil {
+		return err
+	}
+	d.dockerImage = opts.Name
+	d.imageDigest = ""
+	return nil
+}
+
+//
+// pullForPlatform pulls `image` for the platform set with SetPlatform,
+// unless the local image is of it already: the daemon does not pull on
+// create, and fails a create for another platform than the local image's.
+//
+func (d *Client) pullForPlatform(ctx context.Context, image string) error {
+	img, err := d.dockerClient.InspectImage(image)
+	if err == nil && matchesPlatform(img, d.platform) {
+		return nil
+	}
+	if err != nil && err != docker.ErrNoSuchImage {
+		return err
+	}
+	return d.pullImage(ctx, image)
+}
+
+// matchesPlatform reports whether `img` is of `platform`, but for its
+// variant, which an inspect does not show.
+func matchesPlatform(img *docker.Image, platform string) bool {
+	parts := strings.Split(platform, "/")
+	if !strings.EqualFold(img.OS, parts[0]) {
+		return false
+	}
+	return len(parts) < 2 || strings.EqualFold(img.Architecture, parts[1])
+}
+
+//
+// pullImage pulls `image` from its registry, for the platform set with
+// SetPlatform if any. A reference without a tag pulls "latest", not every
+// tag as the API would.
+//
+func (d *Client) pullImage(ctx context.Context, image string) error {
+	opts := docker.PullImageOptions{Repository: image, Platform: d.platform, Context: ctx}
+	if !strings.Contains(image, "@") {
+		opts.Repository, opts.Tag = docker.ParseRepositoryTag(image)
+		if opts.Tag == "" {
+			opts.Tag = "latest"
+		}
+	}
+	if err := d.dockerClient.PullImage(opts, docker.AuthConfiguration{}); err != nil {
+		return fmt.Errorf("dockerpc: pulling %s: %s", image, err)
+	}
+	return nil
+}
+
+//
+// ImageDigest returns the content-addressed reference ("repo@sha256:...",
+// or the image id for images that never went through a registry) that
+// PinDigest resolved the image to, or "" if it has not been resolved.
+//
+func (d *Client) ImageDigest() string {
+	return d.imageDigest
+}
+
+//
+// pinImage returns the digest reference for `image`, resolving it the first
+// time, after pulling it if it is missing; later Starts, say after a Reset,
+// run the same image even if its tag has moved since.
+//
+func (d *Client) pinImage(ctx context.Context, image string) (string, error) {
+	if d.imageDigest != "" {
+		return d.imageDigest, nil
+	}
+	img, err := d.dockerClient.InspectImage(image)
+	if err == docker.ErrNoSuchImage {
+		if err := d.pullImage(ctx, image); err != nil {
+			return "", err
+		}
+		img, err = d.dockerClient.InspectImage(image)
+	}
+	if err != nil {
+		return "", fmt.Errorf("dockerpc: resolving the digest of %s: %s", image, err)
+	}
+	d.imageDigest = digestRef(image, img)
+	return d.imageDigest, nil
+}
+
+//
+// digestRef picks the reference to `img`, the image named `image`, by
+// content: its registry digest for the image's repository, if it has one,
+// or else its id.
+//
+func digestRef(image string, img *docker.Image) string {
+	repo := image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, ref := range img.RepoDigests {
+		if strings.HasPrefix(ref, repo+"@") {
+			return ref
+		}
+	}
+	if len(img.RepoDigests) > 0 {
+		return img.RepoDigests[0]
+	}
+	return img.ID
+}
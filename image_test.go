@@ -0,0 +1,322 @@
+package dockerpc
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// testImages is the image store of a test daemon: inspects see `image`, or
+// no image if it is nil, and pulls are kept, and replace `image` with the
+// image `pulled` for the platform pulled unless pulls fail.
+//
+type testImages struct {
+	mutex    sync.Mutex
+	image    *docker.Image
+	pulled   docker.Image
+	pulls    []url.Values
+	pullFail bool
+}
+
+func newTestImages(daemon *testDaemon, image *docker.Image) *testImages {
+	images := &testImages{image: image, pulled: docker.Image{ID: "sha256:9", RepoDigests: []string{"image@sha256:8"}}}
+	daemon.route("GET /images/{name}/json", func(w http.ResponseWriter, r *http.Request) {
+		images.mutex.Lock()
+		defer images.mutex.Unlock()
+		if images.image == nil {
+			writeJSON(w, 404, map[string]string{"message": "No such image: " + r.PathValue("name")})
+			return
+		}
+		writeJSON(w, 200, images.image)
+	})
+	daemon.route("POST /images/create", func(w http.ResponseWriter, r *http.Request) {
+		images.mutex.Lock()
+		defer images.mutex.Unlock()
+		query := r.URL.Query()
+		images.pulls = append(images.pulls, query)
+		if images.pullFail {
+			writeJSON(w, 404, map[string]string{"message": "pull access denied for " + query.Get("fromImage")})
+			return
+		}
+		pulled := images.pulled
+		pulled.OS, pulled.Architecture = "linux", "amd64"
+		if platform := strings.Split(query.Get("platform"), "/"); len(platform) > 1 {
+			pulled.OS, pulled.Architecture = platform[0], platform[1]
+		}
+		images.image = &pulled
+		writeJSON(w, 200, map[string]string{"status": "Downloaded newer image for " + query.Get("fromImage")})
+	})
+	return images
+}
+
+func (images *testImages) pullQueries() []url.Values {
+	images.mutex.Lock()
+	defer images.mutex.Unlock()
+	return images.pulls
+}
+
+func TestDigestRef(t *testing.T) {
+	tests := []struct {
+		image string
+		img   docker.Image
+		want  string
+	}{
+		{"plugin:latest", docker.Image{ID: "sha256:1", RepoDigests: []string{"plugin@sha256:2"}}, "plugin@sha256:2"},
+		{"plugin", docker.Image{ID: "sha256:1", RepoDigests: []string{"mirror/plugin@sha256:3", "plugin@sha256:2"}}, "plugin@sha256:2"},
+		{"registry:5000/team/plugin:v1", docker.Image{RepoDigests: []string{"registry:5000/team/plugin@sha256:2"}}, "registry:5000/team/plugin@sha256:2"},
+		{"plugin@sha256:2", docker.Image{RepoDigests: []string{"plugin@sha256:2"}}, "plugin@sha256:2"},
+		{"retagged:latest", docker.Image{ID: "sha256:1", RepoDigests: []string{"plugin@sha256:2"}}, "plugin@sha256:2"},
+		// built locally, never pushed.
+		{"plugin:dev", docker.Image{ID: "sha256:1"}, "sha256:1"},
+	}
+	for _, test := range tests {
+		if got := digestRef(test.image, &test.img); got != test.want {
+			t.Errorf("digestRef(%q) = %q, want %q", test.image, got, test.want)
+		}
+	}
+}
+
+func TestPinImageKeepsDigest(t *testing.T) {
+	// no docker client: the digest resolved earlier must be used as is.
+	d := NewClient("", "plugin:latest", "tcp://docker:2375")
+	d.imageDigest = "plugin@sha256:2"
+	if got, err := d.pinImage(context.Background(), "plugin:latest"); err != nil || got != "plugin@sha256:2" {
+		t.Errorf("pinImage = %q, %v; want the recorded digest", got, err)
+	}
+	if got := d.Clone().ImageDigest(); got != "plugin@sha256:2" {
+		t.Errorf("clone runs %q, want the pinned digest", got)
+	}
+}
+
+func TestPlatformPull(t *testing.T) {
+	tests := []struct {
+		name  string
+		local *docker.Image
+		pulls int
+	}{
+		{"missing", nil, 1},
+		{"other platform", &docker.Image{ID: "sha256:1", OS: "linux", Architecture: "amd64"}, 1},
+		{"local", &docker.Image{ID: "sha256:1", OS: "linux", Architecture: "arm64"}, 0},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		images := newTestImages(daemon, test.local)
+		startedClient(t, daemon, func(d *Client) {
+			if err := d.SetPlatform("linux/arm64/v8"); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		pulls := images.pullQueries()
+		if len(pulls) != test.pulls {
+			t.Fatalf("%s: pulled %d times, want %d", test.name, len(pulls), test.pulls)
+		}
+		for _, pull := range pulls {
+			if pull.Get("fromImage") != "image" || pull.Get("tag") != "latest" || pull.Get("platform") != "linux/arm64/v8" {
+				t.Errorf("%s: pulled with %s", test.name, pull.Encode())
+			}
+		}
+		create := daemon.requestsTo("POST", "/containers/create")
+		if len(create) != 1 || create[0].URL.Query().Get("platform") != "linux/arm64/v8" {
+			t.Errorf("%s: created with %v", test.name, create)
+		}
+	}
+}
+
+func TestPlatformPullFails(t *testing.T) {
+	daemon := newTestDaemon(t)
+	images := newTestImages(daemon, nil)
+	images.pullFail = true
+	d := NewClient("", "image", daemon.endpoint())
+	d.SetPlatform("linux/arm64")
+	defer d.Close()
+
+	err := d.Start()
+	if err == nil || !strings.HasPrefix(err.Error(), "dockerpc: pulling image: ") {
+		t.Errorf("Start = %v, want the pull error", err)
+	}
+	if create := daemon.requestsTo("POST", "/containers/create"); len(create) != 0 {
+		t.Error("created the container without its image")
+	}
+}
+
+func TestPullImageTag(t *testing.T) {
+	tests := []struct {
+		image, repository, tag string
+	}{
+		{"plugin", "plugin", "latest"},
+		{"plugin:v1", "plugin", "v1"},
+		{"registry:5000/team/plugin", "registry:5000/team/plugin", "latest"},
+		{"plugin@sha256:2", "plugin", "sha256:2"},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		images := newTestImages(daemon, nil)
+		d := attachedClient(t, daemon, nil)
+		if err := d.pullImage(context.Background(), test.image); err != nil {
+			t.Fatal(err)
+		}
+		pull := images.pullQueries()[0]
+		if pull.Get("fromImage") != test.repository || pull.Get("tag") != test.tag {
+			t.Errorf("pulled %s with %s", test.image, pull.Encode())
+		}
+	}
+}
+
+func TestPinDigest(t *testing.T) {
+	tests := []struct {
+		name  string
+		local *docker.Image
+		pulls int
+		want  string
+	}{
+		{"local", &docker.Image{ID: "sha256:1", RepoDigests: []string{"image@sha256:2"}}, 0, "image@sha256:2"},
+		{"missing", nil, 1, "image@sha256:8"},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		images := newTestImages(daemon, test.local)
+		d := startedClient(t, daemon, func(d *Client) {
+			d.PinDigest = true
+		})
+
+		if got := len(images.pullQueries()); got != test.pulls {
+			t.Errorf("%s: pulled %d times, want %d", test.name, got, test.pulls)
+		}
+		if got := d.ImageDigest(); got != test.want {
+			t.Errorf("%s: pinned %q, want %q", test.name, got, test.want)
+		}
+		var opts struct{ Image string }
+		create := daemon.requestsTo("POST", "/containers/create")[0]
+		json.NewDecoder(create.Body).Decode(&opts)
+		if opts.Image != test.want {
+			t.Errorf("%s: created from %q, want %q", test.name, opts.Image, test.want)
+		}
+	}
+
+	// an image that is neither local nor pullable.
+	daemon := newTestDaemon(t)
+	images := newTestImages(daemon, nil)
+	images.pullFail = true
+	d := NewClient("", "image", daemon.endpoint())
+	d.PinDigest = true
+	defer d.Close()
+	err := d.Start()
+	if err == nil || !strings.HasPrefix(err.Error(), "dockerpc: pulling image: ") {
+		t.Errorf("Start = %v, want the pull error", err)
+	}
+}
+
+// contextTar returns a build context of just `dockerfile`.
+func contextTar(t *testing.T, dockerfile string) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(tw, dockerfile)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestBuildImage(t *testing.T) {
+	daemon := newTestDaemon(t)
+	var dockerfile string
+	daemon.route("POST /build", func(w http.ResponseWriter, r *http.Request) {
+		tr := tar.NewReader(r.Body)
+		if _, err := tr.Next(); err != nil {
+			t.Errorf("built from a context that is not a tar: %v", err)
+		}
+		b, _ := io.ReadAll(tr)
+		dockerfile = string(b)
+		writeJSON(w, 200, map[string]string{"stream": "Successfully tagged " + r.URL.Query().Get("t") + "\n"})
+	})
+
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+	if err := d.SetPlatform("linux/arm64"); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	err := d.BuildImage(context.Background(), docker.BuildImageOptions{
+		Name:         "plugin:dev",
+		InputStream:  contextTar(t, "FROM scratch\n"),
+		OutputStream: &output,
+		NoCache:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := daemon.requestsTo("POST", "/build")[0].URL.Query()
+	if query.Get("t") != "plugin:dev" || query.Get("nocache") != "1" || query.Get("platform") != "linux/arm64" {
+		t.Errorf("built with %s", query.Encode())
+	}
+	if dockerfile != "FROM scratch\n" {
+		t.Errorf("built from the Dockerfile %q", dockerfile)
+	}
+	if !strings.Contains(output.String(), "Successfully tagged plugin:dev") {
+		t.Errorf("streamed the build output %q", output.String())
+	}
+	if d.dockerImage != "plugin:dev" {
+		t.Errorf("Start would run %q, not the built image", d.dockerImage)
+	}
+}
+
+func TestBuildImageStarts(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.route("POST /build", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]string{"stream": "Successfully tagged plugin:dev\n"})
+	})
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+	err := d.BuildImage(context.Background(), docker.BuildImageOptions{Name: "plugin:dev", InputStream: contextTar(t, "FROM scratch\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var opts struct{ Image string }
+	json.NewDecoder(daemon.requestsTo("POST", "/containers/create")[0].Body).Decode(&opts)
+	if opts.Image != "plugin:dev" {
+		t.Errorf("created the container from %q, want the built image", opts.Image)
+	}
+}
+
+func TestBuildImageFails(t *testing.T) {
+	daemon := newTestDaemon(t)
+	daemon.route("POST /build", func(w http.ResponseWriter, r *http.Request) {
+		const msg = "dockerfile parse error line 1: unknown instruction: FORM"
+		writeJSON(w, 200, map[string]interface{}{"errorDetail": map[string]string{"message": msg}, "error": msg})
+	})
+	d := NewClient("", "image", daemon.endpoint())
+	defer d.Close()
+
+	err := d.BuildImage(context.Background(), docker.BuildImageOptions{InputStream: contextTar(t, "FORM scratch\n")})
+	if err == nil || !strings.Contains(err.Error(), "needs a Name") {
+		t.Errorf("BuildImage without a Name = %v", err)
+	}
+	if reqs := daemon.requestsTo("POST", "/build"); len(reqs) != 0 {
+		t.Error("built an image without a Name")
+	}
+
+	err = d.BuildImage(context.Background(), docker.BuildImageOptions{Name: "plugin:dev", InputStream: contextTar(t, "FORM scratch\n")})
+	if err == nil || !strings.Contains(err.Error(), "unknown instruction: FORM") {
+		t.Errorf("BuildImage = %v, want the build error", err)
+	}
+	if d.dockerImage != "image" {
+		t.Errorf("a failed build left Start to run %q", d.dockerImage)
+	}
+}
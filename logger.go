@@ -0,0 +1,19 @@
+package dockerpc
+
+import "log/slog"
+
+//
+// logger returns the logger for the Client's log lines: Logger, or the
+// default one, with the container id as the "container" attribute once
+// there is a container.
+//
+func (d *Client) logger() *slog.Logger {
+	l := d.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	if d.ID != "" {
+		l = l.With("container", d.ID)
+	}
+	return l
+}
@@ -0,0 +1,72 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggerTagsContainer(t *testing.T) {
+	// a daemon that hangs up on the attach request.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	var logs syncBuffer
+	d := NewClient("", "plugin", "tcp://"+l.Addr().String())
+	d.ID = "c0ffee"
+	d.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.attachConn(context.Background(), testAttachOptions); err == nil {
+		t.Fatal("attach to a daemon that hangs up succeeded")
+	}
+	got := logs.String()
+	if !strings.Contains(got, "attach request failed") || !strings.Contains(got, "container=c0ffee") {
+		t.Errorf("got log %q, want the failure tagged with the container", got)
+	}
+}
+
+func TestLoggerWithoutContainer(t *testing.T) {
+	var logs syncBuffer
+	d := &Client{Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	d.logger().Info("hello")
+	if got := logs.String(); !strings.Contains(got, "msg=hello") || strings.Contains(got, "container=") {
+		t.Errorf("got log %q", got)
+	}
+}
@@ -0,0 +1,36 @@
+package dockerpc
+
+import "io"
+
+//
+// TransportMiddleware wraps the transport of the RPC session, the plugin's
+// stdin and stdout as one stream, in a layer of its own: one that logs or
+// counts what it passes on, compresses or encrypts it (with a plugin that
+// undoes it), and so on. What it returns is used in place of `next`, and
+// should pass Read, Write and Close on to it.
+//
+type TransportMiddleware func(next io.ReadWriteCloser) io.ReadWriteCloser
+
+//
+// WithTransportMiddleware adds `mw` to the transport of the RPC session.
+// Each middleware wraps those added before it, so the last one added is
+// the outermost: the codec writes requests to it first and reads responses
+// from it last, while the first one added sits right on the attach stream.
+// A wire log (see SetWireLog) stays outside all of them, and sees the JSON
+// the codec sees.
+//
+// The middleware applies from Start on, and to every session after a
+// Reconnect. The Handshake and ReadyLine exchanges happen before it, and
+// Stats counts the bytes under it. It must be set before Start.
+//
+func (d *Client) WithTransportMiddleware(mw TransportMiddleware) {
+	d.middleware = append(d.middleware, mw)
+}
+
+// wrapTransport applies the transport middleware to `rwc`.
+func (d *Client) wrapTransport(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	for _, mw := range d.middleware {
+		rwc = mw(rwc)
+	}
+	return rwc
+}
@@ -0,0 +1,117 @@
+package dockerpc
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// transportLog records the traffic through recordingMiddleware layers.
+type transportLog struct {
+	mutex  sync.Mutex
+	events []string // "<layer> <read|write>"
+	bytes  map[string]*bytes.Buffer
+}
+
+func (l *transportLog) add(layer, op string, b []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, layer+" "+op)
+	key := layer + " " + op
+	if l.bytes[key] == nil {
+		l.bytes[key] = new(bytes.Buffer)
+	}
+	l.bytes[key].Write(b)
+}
+
+func (l *transportLog) get(layer, op string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if b := l.bytes[layer+" "+op]; b != nil {
+		return b.String()
+	}
+	return ""
+}
+
+func (l *transportLog) middleware(layer string) TransportMiddleware {
+	return func(next io.ReadWriteCloser) io.ReadWriteCloser {
+		return &recordingConn{ReadWriteCloser: next, layer: layer, log: l}
+	}
+}
+
+type recordingConn struct {
+	io.ReadWriteCloser
+	layer string
+	log   *transportLog
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		c.log.add(c.layer, "read", b[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.log.add(c.layer, "write", b)
+	return c.ReadWriteCloser.Write(b)
+}
+
+func TestTransportMiddleware(t *testing.T) {
+	log := &transportLog{bytes: map[string]*bytes.Buffer{}}
+	d := newTestClient(t, func(d *Client) {
+		d.WithTransportMiddleware(log.middleware("inner"))
+		d.WithTransportMiddleware(log.middleware("outer"))
+	})
+
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+
+	for _, layer := range []string{"inner", "outer"} {
+		if got := log.get(layer, "write"); !strings.Contains(got, `"Echo.Echo"`) {
+			t.Errorf("%s layer wrote %q, want the request", layer, got)
+		}
+		if got := log.get(layer, "read"); !strings.Contains(got, `"hi"`) {
+			t.Errorf("%s layer read %q, want the response", layer, got)
+		}
+	}
+	if inner, outer := log.get("inner", "write"), log.get("outer", "write"); inner != outer {
+		t.Errorf("inner layer wrote %q, outer %q", inner, outer)
+	}
+
+	// the request passes the outer layer first, the response the inner one.
+	log.mutex.Lock()
+	events := append([]string(nil), log.events...)
+	log.mutex.Unlock()
+	first := func(op string) string {
+		for _, event := range events {
+			if strings.HasSuffix(event, " "+op) {
+				return event
+			}
+		}
+		return ""
+	}
+	if got := first("write"); got != "outer write" {
+		t.Errorf("first write through %q, want the outer layer", got)
+	}
+	if got := first("read"); got != "inner read" {
+		t.Errorf("first read through %q, want the inner layer", got)
+	}
+}
+
+func TestTransportMiddlewareClone(t *testing.T) {
+	log := &transportLog{bytes: map[string]*bytes.Buffer{}}
+	d := NewClient("", "plugin", "")
+	d.WithTransportMiddleware(log.middleware("inner"))
+
+	c := d.Clone()
+	c.WithTransportMiddleware(log.middleware("outer"))
+	if len(d.middleware) != 1 || len(c.middleware) != 2 {
+		t.Errorf("got %d middleware, and %d on the clone", len(d.middleware), len(c.middleware))
+	}
+}
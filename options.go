@@ -0,0 +1,366 @@
+package dockerpc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// config returns DockerConfig, creating it if needed.
+func (d *Client) config() *docker.Config {
+	if d.DockerConfig == nil {
+		d.DockerConfig = &docker.Config{}
+	}
+	return d.DockerConfig
+}
+
+// hostConfig returns DockerHostConfig, creating it if needed.
+func (d *Client) hostConfig() *docker.HostConfig {
+	if d.DockerHostConfig == nil {
+		d.DockerHostConfig = &docker.HostConfig{}
+	}
+	return d.DockerHostConfig
+}
+
+// validContainerMode checks a "container:<name|id>" namespace mode.
+func validContainerMode(mode string) bool {
+	return strings.HasPrefix(mode, "container:") && len(mode) > len("container:")
+}
+
+//
+// SetIpcMode sets the IPC namespace of the container: "none", "private",
+// "shareable", "host", or "container:<name|id>" to join another
+// container's namespace.
+//
+func (d *Client) SetIpcMode(mode string) error {
+	switch mode {
+	case "", "none", "private", "shareable", "host":
+	default:
+		if !validContainerMode(mode) {
+			return fmt.Errorf("invalid IPC mode: %q", mode)
+		}
+	}
+	d.hostConfig().IpcMode = mode
+	return nil
+}
+
+//
+// SetPidMode sets the PID namespace of the container: "host", or
+// "container:<name|id>" to join another container's namespace.
+//
+func (d *Client) SetPidMode(mode string) error {
+	switch mode {
+	case "", "host":
+	default:
+		if !validContainerMode(mode) {
+			return fmt.Errorf("invalid PID mode: %q", mode)
+		}
+	}
+	d.hostConfig().PidMode = mode
+	return nil
+}
+
+// sysctls docker allows in a container, as they are namespaced.
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+//
+// SetSysctl sets a namespaced kernel parameter in the container. Docker only
+// allows the IPC sysctls (kernel.msg*, kernel.sem, kernel.shm*, fs.mqueue.*)
+// and the network ones (net.*).
+//
+func (d *Client) SetSysctl(key, value string) error {
+	if !ipcSysctls[key] && !namespacedPrefix(key, "fs.mqueue.") && !namespacedPrefix(key, "net.") {
+		return fmt.Errorf("sysctl %q is not namespaced, docker does not allow it", key)
+	}
+
+	hc := d.hostConfig()
+	if hc.Sysctls == nil {
+		hc.Sysctls = make(map[string]string)
+	}
+	hc.Sysctls[key] = value
+	return nil
+}
+
+// namespacedPrefix reports whether `key` is a sysctl under `prefix`.
+func namespacedPrefix(key, prefix string) bool {
+	return strings.HasPrefix(key, prefix) && len(key) > len(prefix)
+}
+
+//
+// AddSecurityOpt adds a security option such as "seccomp=/path/profile.json",
+// "apparmor=profile", "label=type:svirt_t" or "no-new-privileges".
+//
+func (d *Client) AddSecurityOpt(opt string) error {
+	key, value := opt, ""
+	if i := strings.IndexAny(opt, "=:"); i >= 0 {
+		key, value = opt[:i], opt[i+1:]
+	}
+
+	switch key {
+	case "seccomp", "apparmor", "label", "systempaths":
+		if value == "" {
+			return fmt.Errorf("security option %q needs a value", opt)
+		}
+	case "no-new-privileges":
+	default:
+		return fmt.Errorf("unknown security option: %q", opt)
+	}
+
+	hc := d.hostConfig()
+	hc.SecurityOpt = append(hc.SecurityOpt, opt)
+	return nil
+}
+
+// setEnv sets an environment variable in the container, replacing any
+// previous value for `key`.
+func (d *Client) setEnv(key, value string) {
+	config := d.config()
+	entry := key + "=" + value
+	for i, e := range config.Env {
+		if strings.HasPrefix(e, key+"=") {
+			config.Env[i] = entry
+			return
+		}
+	}
+	config.Env = append(config.Env, entry)
+}
+
+//
+// SetEnvFile loads environment variables from a file of KEY=VALUE lines, as
+// used by docker-compose's env_file, and merges them into DockerConfig.Env.
+//
+// The supported format is deliberately small: blank lines and lines starting
+// with # are ignored, an optional leading "export " is dropped, and a value
+// wrapped in matching single or double quotes is unquoted. No variable
+// expansion or escape processing is done.
+//
+func (d *Client) SetEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var env [][2]string
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE, got %q", path, lineno, line)
+		}
+		key := strings.TrimSpace(line[:i])
+		if strings.ContainsAny(key, " \t\"'") {
+			return fmt.Errorf("%s:%d: invalid variable name %q", path, lineno, key)
+		}
+		value := strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, [2]string{key, value})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	// only apply the file once it is known to be valid.
+	for _, kv := range env {
+		d.setEnv(kv[0], kv[1])
+	}
+	return nil
+}
+
+//
+// validHostname reports whether `name` is a legal RFC 1123 host name: dot
+// separated labels of 1-63 letters, digits and hyphens, not starting or
+// ending with a hyphen.
+//
+func validHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetHostname sets the hostname of the container.
+func (d *Client) SetHostname(hostname string) error {
+	if !validHostname(hostname) {
+		return fmt.Errorf("invalid hostname: %q", hostname)
+	}
+	d.config().Hostname = hostname
+	return nil
+}
+
+// SetDomainname sets the domain name of the container.
+func (d *Client) SetDomainname(domainname string) error {
+	if !validHostname(domainname) {
+		return fmt.Errorf("invalid domain name: %q", domainname)
+	}
+	d.config().Domainname = domainname
+	return nil
+}
+
+//
+// AddGroup adds a supplementary group, by name or GID, for the container's
+// process; useful with a non-root user to access mounted host resources.
+//
+func (d *Client) AddGroup(group string) {
+	hc := d.hostConfig()
+	hc.GroupAdd = append(hc.GroupAdd, group)
+}
+
+//
+// validCPUList reports whether `list` is a cpuset list: comma separated
+// numbers or ranges, e.g. "0-3,8".
+//
+func validCPUList(list string) bool {
+	for _, item := range strings.Split(list, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		var ns []int
+		for _, b := range bounds {
+			n, err := strconv.Atoi(b)
+			if err != nil || n < 0 || b[0] == '+' {
+				return false
+			}
+			ns = append(ns, n)
+		}
+		if len(ns) == 2 && ns[0] > ns[1] {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// SetCPUSet pins the container to the CPUs `cpus` and the NUMA memory nodes
+// `mems`, both cpuset lists such as "0-3,8". An empty list leaves that
+// setting unpinned.
+//
+func (d *Client) SetCPUSet(cpus, mems string) error {
+	if cpus != "" && !validCPUList(cpus) {
+		return fmt.Errorf("invalid cpuset cpus: %q", cpus)
+	}
+	if mems != "" && !validCPUList(mems) {
+		return fmt.Errorf("invalid cpuset mems: %q", mems)
+	}
+	hc := d.hostConfig()
+	hc.CPUSetCPUs = cpus
+	hc.CPUSetMEMs = mems
+	return nil
+}
+
+//
+// SetMemoryReservation sets the soft memory limit of the container, in
+// bytes: under memory pressure the kernel reclaims memory from containers
+// over their reservation first, rather than OOM killing them. It must not
+// be above the hard limit (HostConfig.Memory), if there is one; Start
+// checks that again, in case the limit is set afterwards. Zero removes the
+// reservation.
+//
+func (d *Client) SetMemoryReservation(bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("invalid memory reservation: %d", bytes)
+	}
+	hc := d.hostConfig()
+	if err := checkMemory(hc.Memory, bytes); err != nil {
+		return err
+	}
+	hc.MemoryReservation = bytes
+	return nil
+}
+
+// checkMemory fails on a memory reservation above the memory limit.
+func checkMemory(limit, reservation int64) error {
+	if limit > 0 && reservation > limit {
+		return fmt.Errorf("memory reservation of %d bytes is above the %d byte memory limit", reservation, limit)
+	}
+	return nil
+}
+
+//
+// SetOomScoreAdj adjusts how likely the OOM killer is to pick the plugin's
+// processes, from -1000 (never) to 1000 (first), as for
+// /proc/<pid>/oom_score_adj.
+//
+func (d *Client) SetOomScoreAdj(score int) error {
+	if score < -1000 || score > 1000 {
+		return fmt.Errorf("invalid OOM score adjustment: %d, want -1000 to 1000", score)
+	}
+	d.hostConfig().OomScoreAdj = score
+	return nil
+}
+
+//
+// SetStorageOpt sets a storage driver option for the container's writable
+// layer, e.g. SetStorageOpt("size", "10G") to cap its disk usage. Support
+// depends on the daemon's storage driver: "size" needs overlay2 on an xfs
+// backing filesystem mounted with pquota, or devicemapper, btrfs or zfs;
+// the daemon rejects the container otherwise.
+//
+func (d *Client) SetStorageOpt(key, value string) {
+	hc := d.hostConfig()
+	if hc.StorageOpt == nil {
+		hc.StorageOpt = make(map[string]string)
+	}
+	hc.StorageOpt[key] = value
+}
+
+//
+// SetPlatform selects the variant of a multi-arch image to run, as
+// "os[/arch[/variant]]", e.g. "linux/arm64". It applies to the container
+// created by Start and to images built with BuildImage. Start pulls the
+// image for the platform first, unless the local image is of it already;
+// the pull sends no registry credentials.
+//
+func (d *Client) SetPlatform(platform string) error {
+	parts := strings.Split(platform, "/")
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("invalid platform: %q", platform)
+		}
+	}
+	if len(parts) > 3 {
+		return fmt.Errorf("invalid platform: %q", platform)
+	}
+	d.platform = platform
+	return nil
+}
+
+//
+// SetUniqueName names the container `base`, or if a container of that name
+// already exists, the first free one of "base-2", "base-3"... Start fails
+// if none is free after a hundred tries. It takes precedence over
+// ReplaceExisting, as no existing container is ever replaced.
+//
+func (d *Client) SetUniqueName(base string) {
+	d.name = base
+	d.uniqueName = true
+}
@@ -0,0 +1,453 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestSetIpcMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		ok   bool
+	}{
+		{"", true},
+		{"none", true},
+		{"private", true},
+		{"shareable", true},
+		{"host", true},
+		{"container:plugin", true},
+		{"container:", false},
+		{"hots", false},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "")
+		err := d.SetIpcMode(test.mode)
+		if (err == nil) != test.ok {
+			t.Errorf("SetIpcMode(%q) = %v", test.mode, err)
+			continue
+		}
+		if got := d.createOptions().HostConfig.IpcMode; test.ok && got != test.mode {
+			t.Errorf("SetIpcMode(%q) created the container with IpcMode %q", test.mode, got)
+		}
+	}
+}
+
+func TestSetPidMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		ok   bool
+	}{
+		{"", true},
+		{"host", true},
+		{"container:plugin", true},
+		{"container:", false},
+		{"private", false},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "")
+		err := d.SetPidMode(test.mode)
+		if (err == nil) != test.ok {
+			t.Errorf("SetPidMode(%q) = %v", test.mode, err)
+			continue
+		}
+		if got := d.createOptions().HostConfig.PidMode; test.ok && got != test.mode {
+			t.Errorf("SetPidMode(%q) created the container with PidMode %q", test.mode, got)
+		}
+	}
+}
+
+func TestSetSysctl(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"net.ipv4.ip_forward", true},
+		{"net.core.somaxconn", true},
+		{"kernel.shmmax", true},
+		{"kernel.sem", true},
+		{"fs.mqueue.msg_max", true},
+		{"net.", false},
+		{"net", false},
+		{"fs.mqueue.", false},
+		{"kernel.shm", false},
+		{"kernel.hostname", false},
+		{"vm.swappiness", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "")
+		err := d.SetSysctl(test.key, "1")
+		if (err == nil) != test.ok {
+			t.Errorf("SetSysctl(%q) = %v", test.key, err)
+			continue
+		}
+		got := d.createOptions().HostConfig.Sysctls
+		if want := map[string]string{test.key: "1"}; test.ok && !reflect.DeepEqual(got, want) {
+			t.Errorf("SetSysctl(%q) created the container with Sysctls %q", test.key, got)
+		}
+		if !test.ok && len(got) != 0 {
+			t.Errorf("SetSysctl(%q) failed, but set Sysctls %q", test.key, got)
+		}
+	}
+}
+
+func TestAddSecurityOpt(t *testing.T) {
+	tests := []struct {
+		opt string
+		ok  bool
+	}{
+		{"seccomp=/etc/docker/seccomp.json", true},
+		{"seccomp=unconfined", true},
+		{"seccomp:unconfined", true},
+		{"apparmor=docker-default", true},
+		{"label=type:svirt_t", true},
+		{"label:disable", true},
+		{"no-new-privileges", true},
+		{"no-new-privileges:true", true},
+		{"systempaths=unconfined", true},
+		{"seccomp", false},
+		{"seccomp=", false},
+		{"apparmor", false},
+		{"privileged", false},
+		{"selinux=type:svirt_t", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "")
+		err := d.AddSecurityOpt(test.opt)
+		if (err == nil) != test.ok {
+			t.Errorf("AddSecurityOpt(%q) = %v", test.opt, err)
+			continue
+		}
+		got := d.createOptions().HostConfig.SecurityOpt
+		if test.ok && !reflect.DeepEqual(got, []string{test.opt}) {
+			t.Errorf("AddSecurityOpt(%q) created the container with SecurityOpt %q", test.opt, got)
+		}
+		if !test.ok && len(got) != 0 {
+			t.Errorf("AddSecurityOpt(%q) failed, but set SecurityOpt %q", test.opt, got)
+		}
+	}
+
+	d := NewClient("", "image", "")
+	d.AddSecurityOpt("no-new-privileges")
+	d.AddSecurityOpt("seccomp=/etc/docker/seccomp.json")
+	want := []string{"no-new-privileges", "seccomp=/etc/docker/seccomp.json"}
+	if got := d.createOptions().HostConfig.SecurityOpt; !reflect.DeepEqual(got, want) {
+		t.Errorf("created the container with SecurityOpt %q, want %q", got, want)
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	label := strings.Repeat("a", 63)
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"plugin", true},
+		{"plugin-1", true},
+		{"1plugin", true},
+		{"PLUGIN", true},
+		{"plugin.example.com", true},
+		{label, true},
+		{label + "a", false},
+		{strings.Repeat(label+".", 3) + strings.Repeat("a", 61), true}, // 253
+		{strings.Repeat(label+".", 3) + strings.Repeat("a", 62), false},
+		{"", false},
+		{"-plugin", false},
+		{"plugin-", false},
+		{"plugin.-example", false},
+		{"plugin..example", false},
+		{".plugin", false},
+		{"plugin.", false},
+		{"plug_in", false},
+		{"plug in", false},
+		{"plugïn", false},
+	}
+	for _, test := range tests {
+		if got := validHostname(test.name); got != test.ok {
+			t.Errorf("validHostname(%q) = %v, want %v", test.name, got, test.ok)
+		}
+	}
+}
+
+func TestSetHostname(t *testing.T) {
+	d := NewClient("", "image", "")
+	if err := d.SetHostname("plugin-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetDomainname("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetHostname("plug_in"); err == nil {
+		t.Error("SetHostname took an invalid hostname")
+	}
+	if err := d.SetDomainname("example..com"); err == nil {
+		t.Error("SetDomainname took an invalid domain name")
+	}
+	config := d.createOptions().Config
+	if config.Hostname != "plugin-1" || config.Domainname != "example.com" {
+		t.Errorf("created the container with hostname %q, domain name %q", config.Hostname, config.Domainname)
+	}
+}
+
+func TestAddGroup(t *testing.T) {
+	d := NewClient("", "image", "")
+	d.AddGroup("audio")
+	d.AddGroup("1001")
+	want := []string{"audio", "1001"}
+	if got := d.createOptions().HostConfig.GroupAdd; !reflect.DeepEqual(got, want) {
+		t.Errorf("created the container with GroupAdd %q, want %q", got, want)
+	}
+}
+
+func TestValidCPUList(t *testing.T) {
+	tests := []struct {
+		list string
+		ok   bool
+	}{
+		{"0", true},
+		{"0-3", true},
+		{"0-3,8", true},
+		{"1,3,5-7", true},
+		{"3-3", true},
+		{"12-15,0", true},
+		{"", false},
+		{",", false},
+		{"0,", false},
+		{"0-", false},
+		{"-1", false},
+		{"3-1", false},
+		{"1-2-3", false},
+		{"+1", false},
+		{"0-+3", false},
+		{" 1", false},
+		{"a", false},
+		{"0;1", false},
+	}
+	for _, test := range tests {
+		if got := validCPUList(test.list); got != test.ok {
+			t.Errorf("validCPUList(%q) = %v, want %v", test.list, got, test.ok)
+		}
+	}
+}
+
+func TestSetCPUSet(t *testing.T) {
+	d := NewClient("", "image", "")
+	if err := d.SetCPUSet("0-3,8", "0"); err != nil {
+		t.Fatal(err)
+	}
+	hc := d.createOptions().HostConfig
+	if hc.CPUSetCPUs != "0-3,8" || hc.CPUSetMEMs != "0" {
+		t.Errorf("created the container with cpus %q, mems %q", hc.CPUSetCPUs, hc.CPUSetMEMs)
+	}
+
+	if err := d.SetCPUSet("3-1", ""); err == nil {
+		t.Error("SetCPUSet took an invalid cpus list")
+	}
+	if err := d.SetCPUSet("", "0-"); err == nil {
+		t.Error("SetCPUSet took an invalid mems list")
+	}
+	if hc := d.createOptions().HostConfig; hc.CPUSetCPUs != "0-3,8" || hc.CPUSetMEMs != "0" {
+		t.Errorf("a failed SetCPUSet changed the cpuset to %q, %q", hc.CPUSetCPUs, hc.CPUSetMEMs)
+	}
+
+	if err := d.SetCPUSet("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if hc := d.createOptions().HostConfig; hc.CPUSetCPUs != "" || hc.CPUSetMEMs != "" {
+		t.Errorf("empty lists left the cpuset %q, %q", hc.CPUSetCPUs, hc.CPUSetMEMs)
+	}
+}
+
+func TestSetStorageOpt(t *testing.T) {
+	daemon := newTestDaemon(t)
+	startedClient(t, daemon, func(d *Client) {
+		d.SetStorageOpt("size", "1G")
+		d.SetStorageOpt("size", "10G")
+		d.SetStorageOpt("dm.basesize", "20G")
+	})
+
+	var body struct{ HostConfig docker.HostConfig }
+	json.NewDecoder(daemon.requestsTo("POST", "/containers/create")[0].Body).Decode(&body)
+	want := map[string]string{"size": "10G", "dm.basesize": "20G"}
+	if !reflect.DeepEqual(body.HostConfig.StorageOpt, want) {
+		t.Errorf("created the container with storage options %v, want %v", body.HostConfig.StorageOpt, want)
+	}
+}
+
+func TestCreateOptionsCopiesHostConfig(t *testing.T) {
+	d := NewClient("", "image", "")
+	d.SetIpcMode("host")
+
+	opts := d.createOptions()
+	opts.HostConfig.IpcMode = "private"
+	if d.DockerHostConfig.IpcMode != "host" {
+		t.Error("createOptions shares DockerHostConfig with the create options")
+	}
+}
+
+func TestSetEnvFile(t *testing.T) {
+	tests := []struct {
+		file string
+		want []string
+		ok   bool
+	}{
+		{"A=1\nB=2\n", []string{"A=1", "B=2"}, true},
+		{"# comment\n\nexport A=1\n", []string{"A=1"}, true},
+		{"A=\"quoted value\"\nB='single'\n", []string{"A=quoted value", "B=single"}, true},
+		{"A=1\nA=2\n", []string{"A=2"}, true},
+		{"A=$HOME\n", []string{"A=$HOME"}, true},
+		{"A\n", nil, false},
+		{"=1\n", nil, false},
+		{"A B=1\n", nil, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "env")
+		if err := os.WriteFile(path, []byte(test.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewClient("", "image", "")
+		err := d.SetEnvFile(path)
+		if (err == nil) != test.ok {
+			t.Errorf("SetEnvFile(%q) = %v", test.file, err)
+			continue
+		}
+		var got []string
+		if d.DockerConfig != nil {
+			got = d.createOptions().Config.Env
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SetEnvFile(%q) set %q, want %q", test.file, got, test.want)
+		}
+	}
+}
+
+func TestSetEnvFileMissing(t *testing.T) {
+	d := NewClient("", "image", "")
+	if err := d.SetEnvFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("SetEnvFile succeeded on a missing file")
+	}
+}
+
+func TestCreateOptionsKeepsStdinOpen(t *testing.T) {
+	d := NewClient("", "image", "")
+	d.DockerConfig = &docker.Config{Image: "other", Labels: map[string]string{"app": "x"}}
+
+	config := d.createOptions().Config
+	if !config.OpenStdin || config.Image != "image" {
+		t.Errorf("created with OpenStdin %v and image %q", config.OpenStdin, config.Image)
+	}
+	if config.Labels["app"] != "x" || config.Labels[ManagedLabel] != "true" {
+		t.Errorf("created with labels %v", config.Labels)
+	}
+	if d.DockerConfig.OpenStdin {
+		t.Error("createOptions modified DockerConfig")
+	}
+}
+
+func TestStartChecksAttachOptions(t *testing.T) {
+	tests := []struct {
+		opts *docker.AttachToContainerOptions
+		err  string // "" if the options are fine
+	}{
+		{nil, ""},
+		{&docker.AttachToContainerOptions{Stdin: true, Stdout: true}, ""},
+		{&docker.AttachToContainerOptions{Stdin: true, Stdout: true, Stderr: true}, ""},
+		{&docker.AttachToContainerOptions{Stdout: true, Stderr: true}, "must attach stdin"},
+		{&docker.AttachToContainerOptions{Stdin: true, Stderr: true}, "must attach stdout"},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "tcp://docker:2375")
+		d.DockerAttachOptions = test.opts
+		err := d.checkAttachOptions()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", test.opts, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: got %v, want an error with %q", test.opts, err, test.err)
+		}
+		// Start fails before creating anything.
+		if _, err := d.StartContext(context.Background()); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: Start = %v, want an error with %q", test.opts, err, test.err)
+		}
+		if d.ID != "" {
+			t.Errorf("%+v: Start created container %s", test.opts, d.ID)
+		}
+	}
+}
+
+func TestSetMemoryReservation(t *testing.T) {
+	tests := []struct {
+		limit       int64 // HostConfig.Memory, set before
+		reservation int64
+		ok          bool
+	}{
+		{0, 256 << 20, true},
+		{512 << 20, 256 << 20, true},
+		{512 << 20, 512 << 20, true},
+		{256 << 20, 512 << 20, false},
+		{0, -1, false},
+		{512 << 20, 0, true},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "tcp://docker:2375")
+		d.hostConfig().Memory = test.limit
+		err := d.SetMemoryReservation(test.reservation)
+		if (err == nil) != test.ok {
+			t.Errorf("SetMemoryReservation(%d) with limit %d = %v", test.reservation, test.limit, err)
+		}
+		if err == nil && d.DockerHostConfig.MemoryReservation != test.reservation {
+			t.Errorf("SetMemoryReservation(%d) set %d", test.reservation, d.DockerHostConfig.MemoryReservation)
+		}
+	}
+}
+
+func TestStartChecksMemoryReservation(t *testing.T) {
+	// the limit is lowered after the reservation was set.
+	d := NewClient("", "image", "tcp://docker:2375")
+	if err := d.SetMemoryReservation(512 << 20); err != nil {
+		t.Fatal(err)
+	}
+	d.DockerHostConfig.Memory = 256 << 20
+	if _, err := d.StartContext(context.Background()); err == nil || !strings.Contains(err.Error(), "above the") {
+		t.Errorf("Start = %v, want the reservation error", err)
+	}
+	if d.ID != "" {
+		t.Errorf("Start created container %s", d.ID)
+	}
+}
+
+func TestSetOomScoreAdj(t *testing.T) {
+	tests := []struct {
+		score int
+		ok    bool
+	}{
+		{-1000, true},
+		{0, true},
+		{500, true},
+		{1000, true},
+		{-1001, false},
+		{1001, false},
+	}
+	for _, test := range tests {
+		d := NewClient("", "image", "tcp://docker:2375")
+		err := d.SetOomScoreAdj(test.score)
+		if (err == nil) != test.ok {
+			t.Errorf("SetOomScoreAdj(%d) = %v", test.score, err)
+		}
+		if err == nil && d.DockerHostConfig.OomScoreAdj != test.score {
+			t.Errorf("SetOomScoreAdj(%d) set %d", test.score, d.DockerHostConfig.OomScoreAdj)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package dockerpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkConn serves a byte stream in reads of at most `chunk` bytes.
+type chunkConn struct {
+	r     io.Reader
+	chunk int
+}
+
+func (c *chunkConn) Read(b []byte) (int, error) {
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	return c.r.Read(b)
+}
+
+func (c *chunkConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c *chunkConn) Close() error                { return nil }
+
+type testFrame struct {
+	stream  byte
+	payload string
+}
+
+func attachStream(frames ...testFrame) []byte {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		writeFrame(&buf, f.stream, []byte(f.payload))
+	}
+	return buf.Bytes()
+}
+
+// readStdout reads `pipes` to the end, with reads of `size` bytes.
+func readStdout(t *testing.T, pipes *dockerPipes, size int) string {
+	var stdout bytes.Buffer
+	buf := make([]byte, size)
+	for {
+		n, err := pipes.Read(buf)
+		if n == 0 && err == nil {
+			t.Fatal("empty read")
+		}
+		stdout.Write(buf[:n])
+		if err == io.EOF {
+			return stdout.String()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPipesRead(t *testing.T) {
+	manyLogs := []testFrame{}
+	for i := 0; i < 200; i++ {
+		manyLogs = append(manyLogs, testFrame{STDERR, "log line\n"})
+	}
+
+	tests := []struct {
+		name   string
+		frames []testFrame
+		stdout string
+		stderr string
+	}{
+		{"one frame", []testFrame{{STDOUT, `{"id":1}`}}, `{"id":1}`, ""},
+		{"frames back to back", []testFrame{{STDOUT, "ab"}, {STDOUT, "cd"}, {STDOUT, "ef"}}, "abcdef", ""},
+		{"empty frame", []testFrame{{STDOUT, ""}, {STDOUT, "x"}}, "x", ""},
+		{"interleaved stderr", []testFrame{{STDERR, "a\n"}, {STDOUT, "1"}, {STDERR, "b\n"}, {STDOUT, "2"}}, "12", "a\nb\n"},
+		{"stderr before the response", append(manyLogs, testFrame{STDOUT, "reply"}), "reply", strings.Repeat("log line\n", 200)},
+		{"stdin is skipped", []testFrame{{STDIN, "echo"}, {STDOUT, "ok"}}, "ok", ""},
+	}
+
+	for _, test := range tests {
+		stream := attachStream(test.frames...)
+		// whole stream at once, one byte at a time, and split headers.
+		for _, chunk := range []int{len(stream), 1, 5, 11} {
+			for _, size := range []int{1, 3, 1024} {
+				var stderr stderrBuffer
+				pipes := &dockerPipes{
+					conn:     &chunkConn{r: bytes.NewReader(stream), chunk: chunk},
+					stdErr:   &stderr,
+					maxFrame: DefaultMaxFrameSize,
+				}
+				stdout := readStdout(t, pipes, size)
+				if stdout != test.stdout || stderr.String() != test.stderr {
+					t.Errorf("%s, reads of %d/%d: got stdout %q, stderr %q; want %q, %q",
+						test.name, chunk, size, stdout, stderr.String(), test.stdout, test.stderr)
+				}
+			}
+		}
+	}
+}
+
+// countingConn counts the reads of the connection it wraps.
+type countingConn struct {
+	net.Conn
+	reads int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	c.reads++
+	return c.Conn.Read(b)
+}
+
+func TestPipesCoalescedFrames(t *testing.T) {
+	// the daemon sends several frames, and the header of the next one, in
+	// a single write.
+	stream := attachStream(
+		testFrame{STDOUT, `{"id":1}`},
+		testFrame{STDERR, "log\n"},
+		testFrame{STDOUT, `{"id":2}`},
+		testFrame{STDOUT, `{"id":3}`},
+	)
+	client, plugin := net.Pipe()
+	go func() {
+		plugin.Write(stream[:len(stream)-len(`{"id":3}`)])
+		plugin.Write([]byte(`{"id":3}`))
+		plugin.Close()
+	}()
+
+	var stderr stderrBuffer
+	conn := &countingConn{Conn: client}
+	pipes := &dockerPipes{conn: conn, stdErr: &stderr, maxFrame: DefaultMaxFrameSize}
+	stdout := readStdout(t, pipes, 1024)
+	if want := `{"id":1}{"id":2}{"id":3}`; stdout != want || stderr.String() != "log\n" {
+		t.Errorf("got stdout %q, stderr %q; want %q, %q", stdout, stderr.String(), want, "log\n")
+	}
+	// the two writes, and the EOF.
+	if conn.reads != 3 {
+		t.Errorf("read the connection %d times, want 3", conn.reads)
+	}
+}
+
+func TestPipesTruncatedHeader(t *testing.T) {
+	pipes := &dockerPipes{
+		conn:     &chunkConn{r: bytes.NewReader([]byte{1, 0, 0}), chunk: 8},
+		maxFrame: DefaultMaxFrameSize,
+	}
+	if _, err := pipes.Read(make([]byte, 8)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestPipesLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []testFrame
+		lines  []string
+	}{
+		{"one line", []testFrame{{STDERR, "hello\n"}}, []string{"hello"}},
+		{"lines in a frame", []testFrame{{STDERR, "a\nb\n"}}, []string{"a", "b"}},
+		{"line across frames", []testFrame{{STDERR, "he"}, {STDOUT, "x"}, {STDERR, "llo\n"}}, []string{"hello"}},
+		{"blank line", []testFrame{{STDERR, "\n"}}, []string{""}},
+		{"partial line at the end", []testFrame{{STDERR, "a\nrest"}}, []string{"a", "rest"}},
+	}
+	for _, test := range tests {
+		var lines []string
+		pipes := &dockerPipes{
+			conn:       &chunkConn{r: bytes.NewReader(attachStream(test.frames...)), chunk: 1024},
+			stdErrLine: func(line string) { lines = append(lines, line) },
+			maxFrame:   DefaultMaxFrameSize,
+		}
+		readStdout(t, pipes, 1024)
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: got lines %q, want %q", test.name, lines, test.lines)
+		}
+	}
+}
+
+func TestPipesCloseFlushesLine(t *testing.T) {
+	client, plugin := net.Pipe()
+	defer plugin.Close()
+	go func() {
+		writeFrame(plugin, STDERR, []byte("done\npart"))
+		writeFrame(plugin, STDOUT, []byte("x"))
+	}()
+
+	var lines []string
+	pipes := &dockerPipes{
+		conn:       client,
+		stdErrLine: func(line string) { lines = append(lines, line) },
+		maxFrame:   DefaultMaxFrameSize,
+	}
+	if _, err := pipes.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"done"}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got lines %q before Close, want %q", lines, want)
+	}
+	pipes.Close()
+	if want := []string{"done", "part"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got lines %q after Close, want %q", lines, want)
+	}
+}
+
+func TestPipesMaxFrameSize(t *testing.T) {
+	header := func(stream byte, size uint32) []byte {
+		h := make([]byte, 8)
+		h[0] = stream
+		binary.BigEndian.PutUint32(h[4:], size)
+		return h
+	}
+
+	tests := []struct {
+		name     string
+		maxFrame uint32 // MaxFrameSize
+		stream   []byte
+		ok       bool
+	}{
+		{"at the limit", 10, attachStream(testFrame{STDOUT, "0123456789"}), true},
+		{"over the limit", 10, attachStream(testFrame{STDOUT, "0123456789a"}), false},
+		{"stderr over the limit", 10, attachStream(testFrame{STDERR, "0123456789a\n"}), false},
+		{"huge header, no payload", 0, header(STDOUT, 0xffffffff), false},
+		{"default limit", 0, attachStream(testFrame{STDOUT, strings.Repeat("x", 1<<16)}), true},
+	}
+	for _, test := range tests {
+		d := &Client{MaxFrameSize: test.maxFrame}
+		pipes := d.newPipes(&chunkConn{r: bytes.NewReader(test.stream), chunk: 1024})
+
+		var err error
+		for err == nil {
+			_, err = pipes.Read(make([]byte, 1024))
+		}
+		tooBig := strings.Contains(err.Error(), "MaxFrameSize")
+		if test.ok && err != io.EOF || !test.ok && !tooBig {
+			t.Errorf("%s: read ended with %v", test.name, err)
+		}
+	}
+}
+
+func BenchmarkPipesStderr(b *testing.B) {
+	var frames []testFrame
+	for i := 0; i < 100; i++ {
+		frames = append(frames, testFrame{STDERR, "a log line of the plugin\n"}, testFrame{STDOUT, `{"id":1}`})
+	}
+	stream := attachStream(frames...)
+
+	for _, capture := range []bool{true, false} {
+		b.Run(fmt.Sprintf("capture=%v", capture), func(b *testing.B) {
+			b.SetBytes(int64(len(stream)))
+			buf := make([]byte, 1024)
+			for i := 0; i < b.N; i++ {
+				d := &Client{CaptureStderr: capture}
+				d.SetStdErrLineHandler(func(string) {})
+				pipes := d.newPipes(&chunkConn{r: bytes.NewReader(stream), chunk: 1024})
+				d.keepStderr(pipes)
+				for {
+					if _, err := pipes.Read(buf); err != nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// writeBufferConn holds its writes until it is flushed.
+type writeBufferConn struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (c *writeBufferConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *writeBufferConn) Flush() error                { return c.w.Flush() }
+
+func TestRequestsAreFlushed(t *testing.T) {
+	for _, wire := range []bool{false, true} {
+		client, plugin := net.Pipe()
+		go servePlugin(plugin, plugin, plugin)
+
+		conn := &writeBufferConn{Conn: client, w: bufio.NewWriter(client)}
+		d := &Client{clientConn: conn}
+		if wire {
+			d.SetWireLog(io.Discard)
+		}
+		if err := d.startRPC(true); err != nil {
+			t.Fatal(err)
+		}
+		// the request would sit in the buffer, and the call hang.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var reply string
+		if err := d.CallContext(ctx, "Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+			t.Errorf("wire log %v: got %q, %v", wire, reply, err)
+		}
+		cancel()
+		d.Close()
+	}
+}
+
+func TestBatchIsFlushed(t *testing.T) {
+	client, plugin := net.Pipe()
+	go servePlugin(plugin, plugin, plugin)
+
+	conn := &writeBufferConn{Conn: client, w: bufio.NewWriter(client)}
+	d := &Client{clientConn: conn}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// the batch would sit in the buffer, and the calls hang.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var one, two string
+	calls := []BatchCall{
+		{Method: "Echo.Echo", Args: "one", Reply: &one},
+		{Method: "Echo.Echo", Args: "two", Reply: &two},
+	}
+	if err := d.CallBatch(ctx, calls); err != nil {
+		t.Fatal(err)
+	}
+	for i, call := range calls {
+		if call.Error != nil {
+			t.Errorf("call %d: %v", i, call.Error)
+		}
+	}
+	if one != "one" || two != "two" {
+		t.Errorf("got %q, %q", one, two)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	client, plugin := net.Pipe()
+	defer plugin.Close()
+	conn := &writeBufferConn{Conn: client, w: bufio.NewWriter(client)}
+	d := &Client{clientConn: conn}
+	if err := d.Flush(); err != errNotStarted {
+		t.Errorf("Flush before Start = %v, want %v", err, errNotStarted)
+	}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.pipes.Write([]byte("raw input\n"))
+	got := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(plugin).ReadString('\n')
+		got <- line
+	}()
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-got:
+		if line != "raw input\n" {
+			t.Errorf("plugin read %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush did not push the input out")
+	}
+}
@@ -0,0 +1,63 @@
+package dockerpc
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// default interval between polls of the daemon or the plugin.
+const defaultPollInterval = 100 * time.Millisecond
+
+// polls back off to at most this many times the base interval (2^4).
+const maxPollBackoff = 16
+
+//
+// nextPollDelay returns the delay before poll attempt `attempt` (from 0): the
+// base interval doubled per attempt up to maxPollBackoff times, with ±25%
+// jitter so that many clients polling at once spread out.
+//
+func nextPollDelay(base time.Duration, attempt int) time.Duration {
+	backoff := time.Duration(maxPollBackoff)
+	if attempt < 4 {
+		backoff = 1 << uint(attempt)
+	}
+	delay := base * backoff
+	jitter := time.Duration(rand.Int63n(int64(delay)/2+1)) - delay/4
+	return delay + jitter
+}
+
+//
+// poll calls `check` until it reports done, waiting between attempts as
+// described on PollInterval. It gives up when `ctx` is done or, if set,
+// once PollTimeout has passed.
+//
+func (d *Client) poll(ctx context.Context, check func() (bool, error)) error {
+	base := d.PollInterval
+	if base <= 0 {
+		base = defaultPollInterval
+	}
+
+	if d.PollTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.PollTimeout)
+		defer cancel()
+	}
+
+	for attempt := 0; ; attempt++ {
+		done, err := check()
+		if done || err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(nextPollDelay(base, attempt)):
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded && d.PollTimeout > 0 {
+				return fmt.Errorf("dockerpc: gave up waiting after %s", d.PollTimeout)
+			}
+			return ctx.Err()
+		}
+	}
+}
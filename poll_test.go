@@ -0,0 +1,75 @@
+package dockerpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextPollDelay(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 0; attempt < 8; attempt++ {
+		backoff := time.Duration(1) << uint(attempt)
+		if backoff > maxPollBackoff {
+			backoff = maxPollBackoff
+		}
+		want := base * backoff
+		min, max := want*3/4, want*5/4
+		spread := false
+		for i := 0; i < 200; i++ {
+			delay := nextPollDelay(base, attempt)
+			if delay < min || delay > max {
+				t.Fatalf("attempt %d: delay %s, want %s to %s", attempt, delay, min, max)
+			}
+			if delay != want {
+				spread = true
+			}
+		}
+		if !spread {
+			t.Errorf("attempt %d: no jitter around %s", attempt, want)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	d := NewClient("", "image", "")
+	d.PollInterval = 10 * time.Millisecond
+
+	var calls []time.Time
+	err := d.poll(context.Background(), func() (bool, error) {
+		calls = append(calls, time.Now())
+		return len(calls) == 3, nil
+	})
+	if err != nil || len(calls) != 3 {
+		t.Fatalf("poll = %v after %d checks", err, len(calls))
+	}
+	// the first wait is the interval, the second twice it, less the jitter.
+	for i, min := range []time.Duration{7 * time.Millisecond, 15 * time.Millisecond} {
+		if gap := calls[i+1].Sub(calls[i]); gap < min {
+			t.Errorf("check %d came %s after the previous one, want at least %s", i+2, gap, min)
+		}
+	}
+
+	failed := errors.New("no such container")
+	err = d.poll(context.Background(), func() (bool, error) { return false, failed })
+	if err != failed {
+		t.Errorf("poll of a failing check = %v, want %v", err, failed)
+	}
+
+	d.PollTimeout = 50 * time.Millisecond
+	start := time.Now()
+	err = d.poll(context.Background(), func() (bool, error) { return false, nil })
+	if err == nil || err.Error() != "dockerpc: gave up waiting after 50ms" {
+		t.Errorf("poll past PollTimeout = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("poll gave up after %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.poll(ctx, func() (bool, error) { return false, nil }); err != context.Canceled {
+		t.Errorf("poll with a done context = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,98 @@
+package dockerpc
+
+import (
+	"context"
+	"net/rpc"
+)
+
+//
+// Reconnect replaces a broken RPC session with a new one, attached afresh
+// to the still running container, without restarting it. Calls in flight
+// on the old session fail with rpc.ErrShutdown; those to IdempotentMethods
+// are resent automatically.
+//
+// Request ids continue from the old session, so that late responses to the
+// old requests cannot be mistaken for responses to new ones. With
+// Handshake set, the handshake is repeated on the new connection. A session
+// whose codec was upgraded cannot reconnect.
+//
+func (d *Client) Reconnect(ctx context.Context) error {
+	d.reconnecting.Lock()
+	defer d.reconnecting.Unlock()
+	return d.reconnect(ctx)
+}
+
+//
+// resume reconnects after `failed` broke, unless another call already
+// replaced that session.
+//
+func (d *Client) resume(ctx context.Context, failed *rpc.Client) error {
+	d.reconnecting.Lock()
+	defer d.reconnecting.Unlock()
+
+	d.mutex.Lock()
+	current := d.rpcClient
+	d.mutex.Unlock()
+	if current != failed {
+		return nil
+	}
+	return d.reconnect(ctx)
+}
+
+// reconnect does Reconnect; the caller holds d.reconnecting.
+func (d *Client) reconnect(ctx context.Context) error {
+	if err := d.requireContainer(); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return ErrClosed
+	}
+	rpcClient, codec := d.rpcClient, d.codec
+	d.mutex.Unlock()
+
+	if rpcClient != nil && codec == nil {
+		return errNeedsCodec
+	}
+
+	var seq uint64
+	if codec != nil {
+		codec.mutex.Lock()
+		seq = codec.seq
+		codec.mutex.Unlock()
+	}
+	if rpcClient != nil {
+		rpcClient.Close()
+	}
+
+	// attach aside; calls and Close use clientConn under d.mutex.
+	conn, err := d.attach(ctx, d.attachOpts)
+	if err != nil {
+		return err
+	}
+
+	pipes := d.newPipes(conn)
+	if d.attachOpts.Stderr {
+		d.keepStderr(pipes)
+	}
+	if d.Handshake {
+		if err := d.handshake(conn, pipes); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	d.clientConn = conn
+	d.mutex.Unlock()
+
+	d.newSession(conn, pipes, seq)
+	return nil
+}
@@ -0,0 +1,57 @@
+package dockerpc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReconnect(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := newAttachedClient(t, daemon, nil)
+
+	var reply string
+	if err := d.Call("Echo.Echo", "before", &reply); err != nil {
+		t.Fatal(err)
+	}
+	seq := d.codec.seq
+
+	daemon.dropConns()
+	if err := d.Call("Echo.Echo", "broken", &reply); err == nil {
+		t.Fatal("call on a dropped connection succeeded")
+	}
+
+	if err := d.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Call("Echo.Echo", "after", &reply); err != nil || reply != "after" {
+		t.Fatalf("got %q, %v after Reconnect", reply, err)
+	}
+	if d.codec.seq <= seq+1 {
+		t.Errorf("request ids restarted at %d after %d", d.codec.seq, seq)
+	}
+}
+
+func TestReconnectResendsIdempotentCalls(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := newAttachedClient(t, daemon, func(d *Client) {
+		d.IdempotentMethods = map[string]bool{"Echo.Echo": true}
+	})
+
+	var reply string
+	if err := d.Call("Echo.Echo", "before", &reply); err != nil {
+		t.Fatal(err)
+	}
+	daemon.dropConns()
+	if err := d.Call("Echo.Echo", "resent", &reply); err != nil || reply != "resent" {
+		t.Fatalf("got %q, %v; want the call resent", reply, err)
+	}
+}
+
+func TestReconnectAfterClose(t *testing.T) {
+	daemon := newTestDaemon(t)
+	d := newAttachedClient(t, daemon, nil)
+	d.Close()
+	if err := d.Reconnect(context.Background()); err != ErrClosed {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+}
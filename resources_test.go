@@ -0,0 +1,125 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// inspectWith makes `daemon` inspect its container as `c`, or answer
+// `status` with no container if `c` is nil.
+func inspectWith(daemon *testDaemon, c *docker.Container, status int) {
+	daemon.route("GET /containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		if c == nil {
+			writeJSON(w, status, map[string]string{"message": "No such container: " + r.PathValue("id")})
+			return
+		}
+		writeJSON(w, 200, c)
+	})
+}
+
+func TestEffectiveResources(t *testing.T) {
+	pids := int64(64)
+	hostConfig := &docker.HostConfig{
+		Memory:            256 << 20,
+		MemoryReservation: 128 << 20,
+		MemorySwap:        512 << 20,
+		NanoCPUs:          1500000000,
+		CPUShares:         512,
+		PidsLimit:         &pids,
+		OomScoreAdj:       500,
+		Ulimits:           []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+		// not resources
+		Binds:       []string{"/data:/data"},
+		NetworkMode: "none",
+		Privileged:  true,
+	}
+	want := docker.HostConfig{
+		Memory:            256 << 20,
+		MemoryReservation: 128 << 20,
+		MemorySwap:        512 << 20,
+		NanoCPUs:          1500000000,
+		CPUShares:         512,
+		PidsLimit:         &pids,
+		OomScoreAdj:       500,
+		Ulimits:           []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+	}
+
+	running := testContainer()
+	running.HostConfig = hostConfig
+	tests := []struct {
+		name      string
+		container *docker.Container
+		want      docker.HostConfig
+		err       bool
+	}{
+		{"limits", running, want, false},
+		{"no host config", testContainer(), docker.HostConfig{}, true},
+		{"inspect fails", nil, docker.HostConfig{}, true},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		inspectWith(daemon, test.container, 404)
+		d := attachedClient(t, daemon, nil)
+
+		got, err := d.EffectiveResources(context.Background())
+		if (err != nil) != test.err {
+			t.Errorf("%s: EffectiveResources returned %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: EffectiveResources = %+v, want %+v", test.name, got, test.want)
+		}
+		if reqs := daemon.requestsTo("GET", "/containers/plugin/json"); len(reqs) != 1 {
+			t.Errorf("%s: inspected %d times", test.name, len(reqs))
+		}
+	}
+}
+
+func TestEffectiveResourcesNotStarted(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	if _, err := d.EffectiveResources(context.Background()); err != errNotStarted {
+		t.Errorf("EffectiveResources before Start = %v, want %v", err, errNotStarted)
+	}
+}
+
+func TestUpdateResources(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	if err := d.UpdateResources(context.Background(), docker.UpdateContainerOptions{}); err != errNotStarted {
+		t.Errorf("UpdateResources before Start = %v, want %v", err, errNotStarted)
+	}
+
+	daemon := newTestDaemon(t)
+	var mutex sync.Mutex
+	var update map[string]interface{}
+	daemon.route("POST /containers/{id}/update", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		json.NewDecoder(r.Body).Decode(&update)
+		writeJSON(w, 200, map[string][]string{"Warnings": nil})
+	})
+	d = attachedClient(t, daemon, nil)
+	opts := docker.UpdateContainerOptions{Memory: 512 << 20, MemorySwap: 1 << 30, CPUShares: 256}
+	if err := d.UpdateResources(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(daemon.requestsTo("POST", "/containers/plugin/update")) != 1 {
+		t.Fatal("the container was not updated")
+	}
+	mutex.Lock()
+	if update["Memory"] != float64(512<<20) || update["MemorySwap"] != float64(1<<30) || update["CpuShares"] != float64(256) {
+		t.Errorf("updated with %v", update)
+	}
+	mutex.Unlock()
+
+	daemon.route("POST /containers/{id}/update", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 400, map[string]string{"message": "Minimum memory limit allowed is 6MB"})
+	})
+	if err := d.UpdateResources(context.Background(), docker.UpdateContainerOptions{Memory: 1}); err == nil {
+		t.Error("a rejected update succeeded")
+	}
+}
@@ -0,0 +1,182 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//
+// newRawClient returns a JSON-RPC 2.0 Client whose plugin answers each
+// request with the responses `answer` returns for its method, with "%d"
+// replaced by the request id. Requests that are not 2.0 get an error.
+//
+func newRawClient(t *testing.T, answer map[string][]string) *Client {
+	client, plugin := net.Pipe()
+	go func() {
+		var mutex sync.Mutex
+		stdout := &frames{mutex: &mutex, w: plugin, stream: STDOUT}
+		dec := json.NewDecoder(plugin)
+		for {
+			var req struct {
+				Version string `json:"jsonrpc"`
+				Method  string `json:"method"`
+				Id      uint64 `json:"id"`
+			}
+			if err := dec.Decode(&req); err != nil {
+				plugin.Close()
+				return
+			}
+			if req.Version != "2.0" {
+				fmt.Fprintf(stdout, `{"id":%d,"result":null,"error":"not JSON-RPC 2.0"}`+"\n", req.Id)
+				continue
+			}
+			for _, resp := range answer[req.Method] {
+				fmt.Fprintf(stdout, resp+"\n", req.Id)
+			}
+		}
+	}()
+
+	d := &Client{clientConn: client, JSONRPC2: true, CaptureStderr: true}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestRPCError(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want error
+	}{
+		{
+			name: "object with data",
+			resp: `{"jsonrpc":"2.0","id":%d,"error":{"code":-32000,"message":"boom","data":{"retry":true}}}`,
+			want: &RPCError{Code: -32000, Message: "boom", Data: json.RawMessage(`{"retry":true}`)},
+		},
+		{
+			name: "object without data",
+			resp: `{"jsonrpc":"2.0","id":%d,"error":{"code":-32601,"message":"Method not found"}}`,
+			want: &RPCError{Code: -32601, Message: "Method not found"},
+		},
+		{
+			name: "string",
+			resp: `{"jsonrpc":"2.0","id":%d,"error":"plain"}`,
+			want: rpc.ServerError("plain"),
+		},
+		{
+			// a plugin cannot forge an error object from a string.
+			name: "string that looks like an object",
+			resp: `{"jsonrpc":"2.0","id":%d,"error":"\u0000dockerpc.RPCError{\"code\":1,\"message\":\"forged\"}"}`,
+			want: rpc.ServerError("\x00dockerpc.RPCError{\"code\":1,\"message\":\"forged\"}"),
+		},
+	}
+
+	for _, test := range tests {
+		d := newRawClient(t, map[string][]string{
+			"Plugin.Fail": {test.resp},
+			"Plugin.Tail": {`{"jsonrpc":"2.0","id":%d,"result":1,"stream":true}`, test.resp},
+		})
+
+		var reply string
+		err := d.Call("Plugin.Fail", nil, &reply)
+		if !reflect.DeepEqual(err, test.want) {
+			t.Errorf("%s: Call returned %#v, want %#v", test.name, err, test.want)
+		}
+
+		err = d.CallContext(context.Background(), "Plugin.Fail", nil, &reply)
+		if !reflect.DeepEqual(err, test.want) {
+			t.Errorf("%s: CallContext returned %#v, want %#v", test.name, err, test.want)
+		}
+
+		calls := []BatchCall{{Method: "Plugin.Fail", Reply: &reply}}
+		if err := d.CallBatch(context.Background(), calls); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(calls[0].Error, test.want) {
+			t.Errorf("%s: CallBatch returned %#v, want %#v", test.name, calls[0].Error, test.want)
+		}
+
+		stream, err := d.CallStream(context.Background(), "Plugin.Tail", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range stream.C {
+		}
+		if !reflect.DeepEqual(stream.Err(), test.want) {
+			t.Errorf("%s: stream ended with %#v, want %#v", test.name, stream.Err(), test.want)
+		}
+	}
+}
+
+func TestJSONRPC2Results(t *testing.T) {
+	d := newRawClient(t, map[string][]string{
+		"Plugin.Hi":   {`{"jsonrpc":"2.0","id":%d,"result":"hi"}`},
+		"Plugin.Null": {`{"jsonrpc":"2.0","id":%d,"result":null}`},
+	})
+
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"Plugin.Hi", "hi"},
+		// a null result is a valid one in JSON-RPC 2.0.
+		{"Plugin.Null", "unchanged"},
+	}
+	for _, test := range tests {
+		reply := "unchanged"
+		if err := d.Call(test.method, nil, &reply); err != nil || reply != test.want {
+			t.Errorf("%s = %q, %v; want %q", test.method, reply, err, test.want)
+		}
+	}
+}
+
+func TestPanicError(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	for i := 0; i < 2; i++ {
+		var reply string
+		err := d.Call("Echo.Panic", "bad request", &reply)
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) {
+			t.Fatalf("Call = %#v, want a *PanicError", err)
+		}
+		if panicErr.Value != "bad request" || panicErr.Err.Code != PanicCode {
+			t.Errorf("got panic %q, code %d", panicErr.Value, panicErr.Err.Code)
+		}
+		if !strings.Contains(panicErr.Stack, "testEcho).Panic") {
+			t.Errorf("got stack %q, want the handler's", panicErr.Stack)
+		}
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			t.Errorf("%v is not an *RPCError", err)
+		}
+	}
+
+	// the plugin serves on.
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Errorf("Call after the panics = %q, %v", reply, err)
+	}
+}
+
+func TestPanicErrorWithoutStack(t *testing.T) {
+	d := newRawClient(t, map[string][]string{
+		"Plugin.Panic": {`{"jsonrpc":"2.0","id":%d,"error":{"code":-32001,"message":"panic: nil map","data":{"value":"nil map"}}}`},
+	})
+	var reply string
+	err := d.Call("Plugin.Panic", nil, &reply)
+	want := &PanicError{Value: "nil map", Err: &RPCError{Code: PanicCode, Message: "panic: nil map", Data: json.RawMessage(`{"value":"nil map"}`)}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("Call = %#v, want %#v", err, want)
+	}
+}
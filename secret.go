@@ -0,0 +1,122 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// SecretsDir is where AddSecret puts secrets in the container: a tmpfs,
+// with each secret in a file named after it, e.g. /run/secrets/db-password,
+// as with Docker swarm secrets.
+//
+const SecretsDir = "/run/secrets"
+
+// the mount options of the SecretsDir tmpfs.
+const secretsTmpfsOptions = "rw,noexec,nosuid,mode=0755"
+
+//
+// AddSecret makes `data` available to the plugin as the file SecretsDir/name,
+// rather than in an env var, which anyone who can inspect the container
+// sees. Start mounts a tmpfs on SecretsDir, so that the secrets never reach
+// a disk or the container config, and writes the secrets to it once the
+// container is started, before the RPC session, each through an exec of
+// `sh` that reads it on stdin; the image needs a shell, and the plugin
+// should read them when first called, not as soon as it starts. The files
+// are owned by root and readable by every user in the container (mode
+// 0444).
+//
+// Close removes the files if the container is left running (CloseDetach,
+// RemoveOnClose unset); otherwise they go with it. It must be called before
+// Start.
+//
+func (d *Client) AddSecret(name string, data []byte) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid secret name: %q", name)
+	}
+	if d.secrets == nil {
+		d.secrets = make(map[string][]byte)
+	}
+	d.secrets[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// secretsTmpfs returns a copy of `hc` that mounts a tmpfs on SecretsDir,
+// unless it mounts its own.
+func secretsTmpfs(hc *docker.HostConfig) *docker.HostConfig {
+	c := &docker.HostConfig{}
+	if hc != nil {
+		*c = *hc
+	}
+	tmpfs := c.Tmpfs
+	c.Tmpfs = make(map[string]string, len(tmpfs)+1)
+	for dir, options := range tmpfs {
+		c.Tmpfs[dir] = options
+	}
+	if _, ok := c.Tmpfs[SecretsDir]; !ok {
+		c.Tmpfs[SecretsDir] = secretsTmpfsOptions
+	}
+	return c
+}
+
+//
+// writeSecretScript writes its stdin to the file $1, readable by all. The
+// file is created only readable by its owner (umask), then filled.
+//
+const writeSecretScript = `umask 0277 && cat > "$1" && chmod 0444 "$1"`
+
+//
+// writeSecrets writes the secrets to SecretsDir in the started container.
+// The API's archive upload can't (nor can docker cp): the daemon extracts it
+// to the container's filesystem, under the tmpfs. So each secret is piped
+// into a shell exec'd as root instead, which writes it in the container's
+// mounts.
+//
+func (d *Client) writeSecrets(ctx context.Context) error {
+	for _, name := range d.secretNames() {
+		file := path.Join(SecretsDir, name)
+		opts := docker.CreateExecOptions{
+			Cmd:  []string{"sh", "-c", writeSecretScript, "sh", file},
+			User: "0",
+		}
+		_, stderr, code, err := d.exec(ctx, opts, bytes.NewReader(d.secrets[name]))
+		if err == nil && code != 0 {
+			err = fmt.Errorf("sh exited with code %d: %s", code, strings.TrimSpace(stderr))
+		}
+		if err != nil {
+			return fmt.Errorf("dockerpc: writing secret %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// removeSecrets deletes the secret files from the container, for Close.
+func (d *Client) removeSecrets(ctx context.Context) {
+	cmd := []string{"rm", "-f"}
+	for _, name := range d.secretNames() {
+		cmd = append(cmd, path.Join(SecretsDir, name))
+	}
+	_, stderr, code, err := d.exec(ctx, docker.CreateExecOptions{Cmd: cmd, User: "0"}, nil)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("rm exited with code %d: %s", code, strings.TrimSpace(stderr))
+	}
+	if err != nil {
+		d.logger().Warn("removing secrets from the container failed", "err", err)
+	}
+}
+
+// secretNames returns the names of the secrets, sorted.
+func (d *Client) secretNames() []string {
+	names := make([]string, 0, len(d.secrets))
+	for name := range d.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,210 @@
+package dockerpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// runSecretExecs makes `daemon` run the execs of its container with the
+// host's shell, with SecretsDir at `dir`, so that writeSecretScript does
+// what it would in the container.
+//
+func runSecretExecs(daemon *testDaemon, dir string) {
+	daemon.exec = func(cmd []string, stdin []byte) (string, string, int) {
+		args := make([]string, len(cmd)-1)
+		for i, arg := range cmd[1:] {
+			args[i] = strings.Replace(arg, SecretsDir, dir, 1)
+		}
+		c := osexec.Command(cmd[0], args...)
+		c.Stdin = bytes.NewReader(stdin)
+		var stdout, stderr bytes.Buffer
+		c.Stdout, c.Stderr = &stdout, &stderr
+		c.Run()
+		return stdout.String(), stderr.String(), c.ProcessState.ExitCode()
+	}
+}
+
+// secretFiles returns the contents of the files in `dir`, by name, and
+// checks they are readable by all but not writable.
+func secretFiles(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0444 {
+			t.Errorf("%s has mode %o", entry.Name(), mode)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestAddSecret(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	for _, name := range []string{"", ".", "..", "db/password", `db\password`} {
+		if err := d.AddSecret(name, []byte("hunter2")); err == nil {
+			t.Errorf("AddSecret(%q) succeeded", name)
+		}
+	}
+
+	data := []byte("hunter2")
+	if err := d.AddSecret("db-password", data); err != nil {
+		t.Fatal(err)
+	}
+	copy(data, "changed")
+	if got := string(d.secrets["db-password"]); got != "hunter2" {
+		t.Errorf("the secret is %q after the caller changed its data", got)
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	daemon := newTestDaemon(t)
+	dir := t.TempDir()
+	runSecretExecs(daemon, dir)
+	d := attachedClient(t, daemon, nil)
+	d.AddSecret("db-password", []byte("hunter2"))
+	d.AddSecret("api-key", []byte("k3y"))
+	d.AddSecret("it's $HOME", []byte("quoted"))
+
+	if err := d.writeSecrets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"api-key":     "k3y",
+		"db-password": "hunter2",
+		"it's $HOME":  "quoted",
+	}
+	if got := secretFiles(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+	for _, exec := range daemon.startedExecs() {
+		if exec.User != "0" {
+			t.Errorf("%q ran as %q, not root", exec.Cmd, exec.User)
+		}
+		if bytes.Contains([]byte(strings.Join(exec.Cmd, " ")), []byte("hunter2")) {
+			t.Errorf("the secret is in the command: %q", exec.Cmd)
+		}
+	}
+	for _, req := range daemon.requestsTo("POST", "/containers/plugin/exec") {
+		var opts docker.CreateExecOptions
+		json.NewDecoder(req.Body).Decode(&opts)
+		if !opts.AttachStdin {
+			t.Errorf("%q has no stdin", opts.Cmd)
+		}
+	}
+
+	daemon.exec = func(cmd []string, stdin []byte) (string, string, int) {
+		return "", "sh: can't create /run/secrets/api-key: Read-only file system\n", 2
+	}
+	err := d.writeSecrets(context.Background())
+	wantErr := "dockerpc: writing secret api-key: sh exited with code 2: sh: can't create /run/secrets/api-key: Read-only file system"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("failed write = %v, want %s", err, wantErr)
+	}
+}
+
+func TestStartWritesSecrets(t *testing.T) {
+	daemon := newTestDaemon(t)
+	dir := t.TempDir()
+	runSecretExecs(daemon, dir)
+	startedClient(t, daemon, func(d *Client) {
+		d.AddSecret("db-password", []byte("hunter2"))
+	})
+
+	if got := secretFiles(t, dir); got["db-password"] != "hunter2" {
+		t.Errorf("Start wrote %q", got)
+	}
+	create := daemon.requestsTo("POST", "/containers/create")[0]
+	body, _ := io.ReadAll(create.Body)
+	if bytes.Contains(body, []byte("hunter2")) {
+		t.Errorf("the secret is in the create request: %s", body)
+	}
+	var opts struct{ HostConfig docker.HostConfig }
+	json.Unmarshal(body, &opts)
+	if opts.HostConfig.Tmpfs[SecretsDir] != secretsTmpfsOptions {
+		t.Errorf("no tmpfs for the secrets: %q", opts.HostConfig.Tmpfs)
+	}
+}
+
+func TestSecretsNotInConfig(t *testing.T) {
+	d := NewClient("", "image", "tcp://docker:2375")
+	d.setEnv("MODE", "test")
+	d.DockerHostConfig = &docker.HostConfig{Tmpfs: map[string]string{"/tmp": "size=1m"}}
+	d.AddSecret("db-password", []byte("hunter2"))
+
+	opts := d.createOptions()
+	opts.HostConfig = secretsTmpfs(opts.HostConfig)
+
+	b, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("hunter2")) {
+		t.Errorf("the secret is in the container options: %s", b)
+	}
+	for _, env := range opts.Config.Env {
+		if bytes.Contains([]byte(env), []byte("hunter2")) {
+			t.Errorf("the secret is in the env: %q", env)
+		}
+	}
+	want := map[string]string{"/tmp": "size=1m", SecretsDir: secretsTmpfsOptions}
+	if !reflect.DeepEqual(opts.HostConfig.Tmpfs, want) {
+		t.Errorf("tmpfs mounts %q, want %q", opts.HostConfig.Tmpfs, want)
+	}
+	if len(d.DockerHostConfig.Tmpfs) != 1 {
+		t.Errorf("DockerHostConfig was changed: %q", d.DockerHostConfig.Tmpfs)
+	}
+
+	if hc := secretsTmpfs(nil); hc.Tmpfs[SecretsDir] != secretsTmpfsOptions {
+		t.Errorf("no tmpfs for the secrets without a host config: %q", hc.Tmpfs)
+	}
+}
+
+func TestSecretsRemovedOnClose(t *testing.T) {
+	tests := []struct {
+		mode CloseMode
+		cmd  []string // nil for no exec
+	}{
+		{CloseDetach, []string{"rm", "-f", "/run/secrets/api-key", "/run/secrets/db-password"}},
+		{CloseForce, nil},
+		{CloseGraceful, nil},
+	}
+	for _, test := range tests {
+		daemon := newTestDaemon(t)
+		d := attachedClient(t, daemon, func(d *Client) {
+			d.CloseMode = test.mode
+			d.AddSecret("db-password", []byte("hunter2"))
+			d.AddSecret("api-key", []byte("k3y"))
+		})
+
+		d.Close()
+		var want [][]string
+		if test.cmd != nil {
+			want = [][]string{test.cmd}
+		}
+		if got := daemon.execCmds(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Close ran %q, want %q", test.mode, got, want)
+		}
+	}
+}
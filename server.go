@@ -0,0 +1,381 @@
+package dockerpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//
+// Server is a JSON-RPC server for the plugin side of a dockerpc connection.
+//
+// It speaks the same wire format as net/rpc/jsonrpc, so a plugin built on it
+// works with any dockerpc Client, and additionally supports streaming
+// methods. Methods are registered like net/rpc methods:
+//
+//	func (t *T) MethodName(args A, reply *R) error
+//
+// A streaming method takes a *Stream in place of the reply:
+//
+//	func (t *T) MethodName(args A, stream *Stream) error
+//
+// The registered methods are listed to clients by Client.Methods.
+//
+// Streaming contract: for each value passed to stream.Send the server writes
+// a response carrying the request id and `"stream": true`. When the method
+// returns, a final response for the same id without the stream flag (and
+// with a null result, or the error) ends the stream.
+//
+// Typical plugin usage:
+//
+//	s := dockerpc.NewServer()
+//	s.RegisterName("Plugin", api{})
+//	s.ServeConn(dockerpc.Stdio())
+//
+type Server struct {
+	// a handler that panics fails its call with a PanicCode error, which
+	// the Client returns as a *PanicError, and the Server serves on.
+	// PanicStack makes the error carry the handler's stack; set it before
+	// ServeConn.
+	PanicStack bool
+
+	mutex    sync.RWMutex
+	services map[string]*service
+	upgrade  func(conn io.ReadWriteCloser)
+}
+
+type service struct {
+	rcvr    reflect.Value
+	methods map[string]*serverMethod
+}
+
+type serverMethod struct {
+	method    reflect.Method
+	argType   reflect.Type
+	replyType reflect.Type
+	stream    bool
+}
+
+var (
+	typeOfError  = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfStream = reflect.TypeOf((*Stream)(nil))
+)
+
+// NewServer returns a Server with no registered services.
+func NewServer() *Server {
+	return &Server{services: make(map[string]*service)}
+}
+
+// Register publishes the methods of `rcvr` under the name of its type.
+func (s *Server) Register(rcvr interface{}) error {
+	name := reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name()
+	return s.RegisterName(name, rcvr)
+}
+
+// RegisterName publishes the methods of `rcvr` under `name`.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("dockerpc: no service name for type " + reflect.TypeOf(rcvr).String())
+	}
+
+	svc := &service{
+		rcvr:    reflect.ValueOf(rcvr),
+		methods: make(map[string]*serverMethod),
+	}
+
+	typ := reflect.TypeOf(rcvr)
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		if !m.IsExported() {
+			continue
+		}
+		mtype := m.Type
+		if mtype.NumIn() != 3 || mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+			continue
+		}
+		replyType := mtype.In(2)
+		if replyType.Kind() != reflect.Ptr {
+			continue
+		}
+		svc.methods[m.Name] = &serverMethod{
+			method:    m,
+			argType:   mtype.In(1),
+			replyType: replyType,
+			stream:    replyType == typeOfStream,
+		}
+	}
+
+	if len(svc.methods) == 0 {
+		return errors.New("dockerpc: type " + typ.String() + " has no suitable methods")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.services[name]; ok {
+		return errors.New("dockerpc: service already defined: " + name)
+	}
+	s.services[name] = svc
+	return nil
+}
+
+//
+// HandleUpgrade lets clients switch the connection to another codec with
+// Client.UpgradeCodec. Once the in-flight requests are answered and the
+// upgrade is acknowledged, ServeConn hands the connection to `serve`, which
+// should serve it with the matching server codec, e.g.:
+//
+//	s.HandleUpgrade(func(conn io.ReadWriteCloser) {
+//		rpcServer.ServeConn(conn) // gob
+//	})
+//
+func (s *Server) HandleUpgrade(serve func(conn io.ReadWriteCloser)) {
+	s.mutex.Lock()
+	s.upgrade = serve
+	s.mutex.Unlock()
+}
+
+type serverRequest struct {
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+	Id     *json.RawMessage `json:"id"`
+}
+
+type serverResponse struct {
+	Id     *json.RawMessage `json:"id"`
+	Result interface{}      `json:"result"`
+	Error  interface{}      `json:"error"`
+	Stream bool             `json:"stream,omitempty"`
+}
+
+// serverConn is the state of one connection being served.
+type serverConn struct {
+	enc   *json.Encoder
+	mutex sync.Mutex // serializes writes to enc
+}
+
+func (sc *serverConn) respond(resp *serverResponse) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.enc.Encode(resp)
+}
+
+//
+// ServeConn runs the server on a single connection, handling requests
+// concurrently until the connection is closed or fails.
+//
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	sc := &serverConn{enc: json.NewEncoder(conn)}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		var req serverRequest
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if req.Method == upgradeMethod {
+			s.mutex.RLock()
+			serve := s.upgrade
+			s.mutex.RUnlock()
+			if serve == nil {
+				sc.respond(&serverResponse{Id: req.Id, Error: "dockerpc: server does not support codec upgrades"})
+				continue
+			}
+
+			// answer everything in flight before switching.
+			wg.Wait()
+			if err := sc.respond(&serverResponse{Id: req.Id, Result: true}); err != nil {
+				return err
+			}
+			serve(&upgradedConn{Reader: afterJSON(dec, conn), WriteCloser: conn})
+			return nil
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(sc, &req)
+		}()
+	}
+}
+
+type serverErrorObject struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (s *Server) handle(sc *serverConn, req *serverRequest) {
+	resp := &serverResponse{Id: req.Id}
+	defer func() {
+		if v := recover(); v != nil {
+			resp.Result = nil
+			resp.Error = s.panicError(v)
+		}
+		sc.respond(resp)
+	}()
+
+	result, err := s.call(sc, req)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result = result
+	}
+}
+
+// panicError is the error object answering a call whose handler panicked
+// with `v`; it runs in the deferred recover, so the stack is the handler's.
+func (s *Server) panicError(v interface{}) *serverErrorObject {
+	data := panicData{Value: fmt.Sprint(v)}
+	if s.PanicStack {
+		data.Stack = string(debug.Stack())
+	}
+	return &serverErrorObject{Code: PanicCode, Message: "panic: " + data.Value, Data: data}
+}
+
+// methods returns the "Service.Method" names of the registered methods.
+func (s *Server) methods() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := []string{}
+	for serviceName, svc := range s.services {
+		for methodName := range svc.methods {
+			names = append(names, serviceName+"."+methodName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) lookup(serviceMethod string) (*service, *serverMethod, error) {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return nil, nil, errors.New("rpc: service/method request ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+
+	s.mutex.RLock()
+	svc := s.services[serviceName]
+	s.mutex.RUnlock()
+	if svc == nil {
+		return nil, nil, errors.New("rpc: can't find service " + serviceMethod)
+	}
+
+	m := svc.methods[methodName]
+	if m == nil {
+		return nil, nil, errors.New("rpc: can't find method " + serviceMethod)
+	}
+	return svc, m, nil
+}
+
+func (s *Server) call(sc *serverConn, req *serverRequest) (interface{}, error) {
+	if req.Method == methodsMethod {
+		return s.methods(), nil
+	}
+
+	svc, m, err := s.lookup(req.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	var argv reflect.Value
+	argIsValue := false
+	if m.argType.Kind() == reflect.Ptr {
+		argv = reflect.New(m.argType.Elem())
+	} else {
+		argv = reflect.New(m.argType)
+		argIsValue = true
+	}
+
+	if req.Params == nil {
+		return nil, errors.New("jsonrpc: request body missing params")
+	}
+	var params [1]interface{}
+	params[0] = argv.Interface()
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		return nil, err
+	}
+	if argIsValue {
+		argv = argv.Elem()
+	}
+
+	var replyv reflect.Value
+	if m.stream {
+		replyv = reflect.ValueOf(&Stream{id: req.Id, conn: sc})
+	} else {
+		replyv = reflect.New(m.replyType.Elem())
+		switch m.replyType.Elem().Kind() {
+		case reflect.Map:
+			replyv.Elem().Set(reflect.MakeMap(m.replyType.Elem()))
+		case reflect.Slice:
+			replyv.Elem().Set(reflect.MakeSlice(m.replyType.Elem(), 0, 0))
+		}
+	}
+
+	out := m.method.Func.Call([]reflect.Value{svc.rcvr, argv, replyv})
+	if errInter := out[0].Interface(); errInter != nil {
+		return nil, errInter.(error)
+	}
+
+	if m.stream {
+		// the final, unflagged response ends the stream.
+		return nil, nil
+	}
+	return replyv.Interface(), nil
+}
+
+//
+// Stream is handed to streaming methods in place of a reply; each Send
+// delivers one value to the calling client.
+//
+type Stream struct {
+	id   *json.RawMessage
+	conn *serverConn
+}
+
+// Send writes `v` to the client as the next value of the stream.
+func (st *Stream) Send(v interface{}) error {
+	err := st.conn.respond(&serverResponse{Id: st.id, Result: v, Stream: true})
+	if err != nil {
+		return fmt.Errorf("dockerpc: stream send: %s", err)
+	}
+	return nil
+}
+
+//
+// Stdio returns the plugin's stdin and stdout as a single connection, which
+// is how a dockerpc Client reaches a plugin through `docker attach`.
+//
+func Stdio() io.ReadWriteCloser {
+	return stdio{}
+}
+
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error) {
+	return os.Stdin.Read(b)
+}
+
+func (stdio) Write(b []byte) (int, error) {
+	return os.Stdout.Write(b)
+}
+
+func (stdio) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
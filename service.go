@@ -0,0 +1,46 @@
+package dockerpc
+
+import "context"
+
+//
+// ServiceClient calls the methods of one RPC service on the plugin, so
+// callers can write
+//
+//	client.Service("Plugin").Call("SayHi", "jen", &result)
+//
+// instead of spelling out "Plugin.SayHi".
+//
+type ServiceClient struct {
+	client *Client
+	name   string
+}
+
+//
+// Methods lists the "Service.Method" names the plugin serves, for tooling
+// and discovery. net/rpc has no such listing, so this relies on a convention:
+// the plugin answers the reserved "_dockerpc.Methods" call with the names,
+// which a Server does for its registered services. Other plugins fail it
+// with their usual unknown method error.
+//
+func (d *Client) Methods(ctx context.Context) ([]string, error) {
+	var names []string
+	if err := d.CallContext(ctx, methodsMethod, nil, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Service returns a ServiceClient for the service registered as `name`.
+func (d *Client) Service(name string) *ServiceClient {
+	return &ServiceClient{client: d, name: name}
+}
+
+// Call calls `method` of the service; see Client.Call.
+func (s *ServiceClient) Call(method string, args interface{}, reply interface{}) error {
+	return s.client.Call(s.name+"."+method, args, reply)
+}
+
+// CallContext calls `method` of the service; see Client.CallContext.
+func (s *ServiceClient) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return s.client.CallContext(ctx, s.name+"."+method, args, reply)
+}
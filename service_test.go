@@ -0,0 +1,36 @@
+package dockerpc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	want := []string{"Echo.Count", "Echo.CountFail", "Echo.Echo", "Echo.Fail", "Echo.Panic", "Echo.Sleep", "Echo.Swap"}
+	tests := []struct {
+		name      string
+		formatter func(string) string
+	}{
+		{"plain", nil},
+		// the reserved method is not formatted.
+		{"formatter", strings.ToLower},
+	}
+	for _, test := range tests {
+		d := newTestClient(t, func(d *Client) {
+			d.MethodFormatter = test.formatter
+		})
+		got, err := d.Methods(context.Background())
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Methods = %q, %v; want %q", test.name, got, err, want)
+		}
+	}
+}
+
+func TestMethodsUnsupported(t *testing.T) {
+	d := newGobClient(t)
+	if _, err := d.Methods(context.Background()); err == nil {
+		t.Error("Methods succeeded against a plain net/rpc plugin")
+	}
+}
@@ -0,0 +1,55 @@
+package dockerpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// SessionLabel is set to the Client's SessionID on the containers it
+// creates, see ReapSession.
+const SessionLabel = "dockerpc.session"
+
+//
+// ReapSession force-removes every container created by dockerpc on
+// `endpoint` with `sessionID` as its SessionID, running or not, so that an
+// orchestrator can clean up all that a session started in one call, even
+// after it restarted and lost track of the Clients. Containers without
+// ManagedLabel are left alone whatever their labels. It returns the
+// errors of the removals that failed, joined.
+//
+func ReapSession(ctx context.Context, endpoint string, sessionID string) error {
+	if sessionID == "" {
+		return errors.New("dockerpc: ReapSession needs a session id")
+	}
+	d := NewClient("", "", endpoint)
+	if err := d.connect(); err != nil {
+		return err
+	}
+
+	containers, err := d.dockerClient.ListContainers(docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"label": {ManagedLabel + "=true", SessionLabel + "=" + sessionID},
+		},
+		Context: ctx,
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, c := range containers {
+		// the daemon did the filtering; make sure of it before removing.
+		if c.Labels[ManagedLabel] != "true" || c.Labels[SessionLabel] != sessionID {
+			continue
+		}
+		err := d.dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID, Force: true, Context: ctx})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("removing %s: %s", c.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
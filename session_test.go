@@ -0,0 +1,124 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeContainers holds the containers of a test daemon, listed with label
+// filters like docker.
+type fakeContainers struct {
+	mutex      sync.Mutex
+	containers map[string]map[string]string // labels by id
+	removeErr  string                       // the daemon's answer to removals, if set
+}
+
+func newFakeContainers(daemon *testDaemon) *fakeContainers {
+	f := &fakeContainers{containers: make(map[string]map[string]string)}
+	daemon.route("GET /containers/json", f.list)
+	daemon.route("DELETE /containers/{id}", f.remove)
+	return f
+}
+
+func (f *fakeContainers) create(opts docker.CreateContainerOptions) {
+	f.mutex.Lock()
+	f.containers[fmt.Sprint(len(f.containers))] = opts.Config.Labels
+	f.mutex.Unlock()
+}
+
+func (f *fakeContainers) list(w http.ResponseWriter, r *http.Request) {
+	var filters map[string][]string
+	json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	list := []docker.APIContainers{}
+next:
+	for id, labels := range f.containers {
+		for _, filter := range filters["label"] {
+			key, value, _ := strings.Cut(filter, "=")
+			if labels[key] != value {
+				continue next
+			}
+		}
+		list = append(list, docker.APIContainers{ID: id, Labels: labels})
+	}
+	writeJSON(w, 200, list)
+}
+
+func (f *fakeContainers) remove(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.removeErr != "" {
+		writeJSON(w, 409, map[string]string{"message": f.removeErr})
+		return
+	}
+	delete(f.containers, r.PathValue("id"))
+	w.WriteHeader(204)
+}
+
+func (f *fakeContainers) ids() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var ids []string
+	for id := range f.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestReapSession(t *testing.T) {
+	daemon := newTestDaemon(t)
+	containers := newFakeContainers(daemon)
+	for _, session := range []string{"a", "b", "a", "", "a"} {
+		d := NewClient("", "image", daemon.endpoint())
+		d.SessionID = session
+		containers.create(d.createOptions())
+	}
+	// not created by dockerpc.
+	containers.containers["other"] = map[string]string{SessionLabel: "a"}
+
+	if err := ReapSession(context.Background(), daemon.endpoint(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := containers.ids(), []string{"1", "3", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left containers %q, want %q", got, want)
+	}
+	if got := containers.containers["1"][SessionLabel]; got != "b" {
+		t.Errorf("container of session b is labeled %q", got)
+	}
+	if _, ok := containers.containers["3"][SessionLabel]; ok {
+		t.Error("container without a session has a session label")
+	}
+	if removes := daemon.requestsTo("DELETE", "/containers/0"); len(removes) != 1 || removes[0].URL.Query().Get("force") != "1" {
+		t.Errorf("removed container 0 with %v", removes)
+	}
+}
+
+func TestReapSessionErrors(t *testing.T) {
+	daemon := newTestDaemon(t)
+	containers := newFakeContainers(daemon)
+	containers.removeErr = "busy"
+	d := NewClient("", "image", daemon.endpoint())
+	d.SessionID = "a"
+	containers.create(d.createOptions())
+	containers.create(d.createOptions())
+
+	err := ReapSession(context.Background(), daemon.endpoint(), "a")
+	if err == nil || strings.Count(err.Error(), "busy") != 2 {
+		t.Errorf("reap = %v, want both removal errors", err)
+	}
+	if err := ReapSession(context.Background(), daemon.endpoint(), ""); err == nil {
+		t.Error("reaped without a session id")
+	}
+}
@@ -0,0 +1,54 @@
+package dockerpc
+
+import (
+	"context"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// ResourceStats streams the resource usage (CPU, memory, network...) of the
+// plugin container, as reported by the daemon about once a second. The
+// channel is closed when `ctx` is done, the container exits, or the Client is
+// closed.
+//
+func (d *Client) ResourceStats(ctx context.Context) (<-chan *docker.Stats, error) {
+	if err := d.requireContainer(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		cancel()
+		return nil, ErrClosed
+	}
+	d.stopStats = append(d.stopStats, cancel)
+	d.mutex.Unlock()
+
+	// the stats stream outlives the container; end it when the container
+	// exits.
+	go func() {
+		d.dockerClient.WaitContainerWithContext(d.ID, ctx)
+		cancel()
+	}()
+
+	// the docker client closes ch once the stream ends.
+	ch := make(chan *docker.Stats)
+	go func() {
+		err := d.dockerClient.Stats(docker.StatsOptions{
+			ID:      d.ID,
+			Stats:   ch,
+			Stream:  true,
+			Context: ctx,
+		})
+		if err != nil && ctx.Err() == nil {
+			d.logger().Warn("stats stream ended with error", "err", err)
+		}
+		cancel()
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,112 @@
+package dockerpc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+//
+// statsDaemon returns a test daemon whose container streams the stats sent
+// on daemon.stats, and runs until `exit` is closed.
+//
+func statsDaemon(t *testing.T) (daemon *testDaemon, exit chan struct{}) {
+	daemon = newTestDaemon(t)
+	daemon.stats = make(chan docker.Stats, 2)
+	exit = make(chan struct{})
+	released := make(chan struct{})
+	t.Cleanup(func() { close(released) })
+	daemon.route("POST /containers/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-exit:
+		case <-released:
+		}
+		writeJSON(w, 200, map[string]int{"StatusCode": 0})
+	})
+	return daemon, exit
+}
+
+// drained reports whether `ch` is closed within a few seconds, once
+// drained.
+func drained(ch <-chan *docker.Stats) bool {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestResourceStats(t *testing.T) {
+	daemon, _ := statsDaemon(t)
+	daemon.stats <- docker.Stats{NumProcs: 3}
+	daemon.stats <- docker.Stats{NumProcs: 4}
+	close(daemon.stats)
+	d := startedClient(t, daemon, nil)
+
+	ch, err := d.ResourceStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var procs []uint32
+	for s := range ch {
+		procs = append(procs, s.NumProcs)
+	}
+	if len(procs) != 2 || procs[0] != 3 || procs[1] != 4 {
+		t.Errorf("got process counts %v, want [3 4]", procs)
+	}
+	if query := daemon.requestsTo("GET", "/containers/plugin/stats")[0].URL.Query(); query.Get("stream") != "true" {
+		t.Errorf("asked for stats with %s", query.Encode())
+	}
+}
+
+func TestResourceStatsEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		end  func(d *Client, cancel context.CancelFunc, exit chan struct{})
+	}{
+		{"cancel", func(d *Client, cancel context.CancelFunc, exit chan struct{}) { cancel() }},
+		{"exit", func(d *Client, cancel context.CancelFunc, exit chan struct{}) { close(exit) }},
+		{"close", func(d *Client, cancel context.CancelFunc, exit chan struct{}) { d.Close() }},
+	}
+	for _, test := range tests {
+		daemon, exit := statsDaemon(t)
+		d := startedClient(t, daemon, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		ch, err := d.ResourceStats(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		daemon.stats <- docker.Stats{NumProcs: 1}
+		if s := <-ch; s == nil || s.NumProcs != 1 {
+			t.Fatalf("%s: got %v for the first stats", test.name, s)
+		}
+		test.end(d, cancel, exit)
+		if !drained(ch) {
+			t.Errorf("%s: the stats channel stayed open", test.name)
+		}
+		cancel()
+	}
+}
+
+func TestResourceStatsRequiresContainer(t *testing.T) {
+	if _, err := NewClient("", "image", "").ResourceStats(context.Background()); err != errNotStarted {
+		t.Errorf("ResourceStats before Start = %v, want %v", err, errNotStarted)
+	}
+
+	daemon, _ := statsDaemon(t)
+	d := startedClient(t, daemon, nil)
+	d.Close()
+	if _, err := d.ResourceStats(context.Background()); err == nil {
+		t.Error("ResourceStats after Close succeeded")
+	}
+}
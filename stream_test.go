@@ -0,0 +1,78 @@
+package dockerpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/rpc"
+	"reflect"
+	"testing"
+)
+
+func TestCallStream(t *testing.T) {
+	tests := []struct {
+		method string
+		n      int
+		want   []int
+		err    error
+	}{
+		{"Echo.Count", 3, []int{0, 1, 2}, nil},
+		{"Echo.Count", 0, nil, nil},
+		{"Echo.CountFail", 2, []int{0, 1}, rpc.ServerError("count failed")},
+		{"Echo.CountFail", 0, nil, rpc.ServerError("count failed")},
+	}
+
+	d := newTestClient(t, nil)
+	for _, test := range tests {
+		stream, err := d.CallStream(context.Background(), test.method, test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for raw := range stream.C {
+			var i int
+			if err := json.Unmarshal(raw, &i); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, i)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s(%d) streamed %v, want %v", test.method, test.n, got, test.want)
+		}
+		if err := stream.Err(); err != test.err {
+			t.Errorf("%s(%d) ended with %v, want %v", test.method, test.n, err, test.err)
+		}
+	}
+}
+
+func TestCallStreamCanceled(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := d.CallStream(ctx, "Echo.Count", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stream.C
+	cancel()
+	for range stream.C {
+	}
+	if err := stream.Err(); err != context.Canceled {
+		t.Errorf("canceled stream ended with %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCallStreamConnectionLost(t *testing.T) {
+	d := newTestClient(t, nil)
+
+	stream, err := d.CallStream(context.Background(), "Echo.Count", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stream.C
+	d.clientConn.Close()
+	for range stream.C {
+	}
+	if stream.Err() == nil {
+		t.Error("stream ended without an error when the connection was lost")
+	}
+}
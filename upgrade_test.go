@@ -0,0 +1,151 @@
+package dockerpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gobClientCodec is net/rpc's gob client codec, which is not exported.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	w := bufio.NewWriter(conn)
+	return &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(w), w}
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error { return c.dec.Decode(r) }
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error  { return c.dec.Decode(body) }
+func (c *gobClientCodec) Close() error                             { return c.rwc.Close() }
+
+//
+// newUpgradableClient is like newTestClient, but the plugin serves gob
+// once the client upgrades its codec.
+//
+func newUpgradableClient(t *testing.T) *Client {
+	client, plugin := net.Pipe()
+	go func() {
+		var mutex sync.Mutex
+		stdout := &frames{mutex: &mutex, w: plugin, stream: STDOUT}
+		stderr := &frames{mutex: &mutex, w: plugin, stream: STDERR}
+
+		s := NewServer()
+		s.RegisterName("Echo", &testEcho{stderr: stderr})
+		s.HandleUpgrade(func(conn io.ReadWriteCloser) {
+			gs := rpc.NewServer()
+			gs.RegisterName("Echo", &testEcho{stderr: stderr})
+			gs.ServeConn(conn)
+		})
+		s.ServeConn(&struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{plugin, stdout, plugin})
+	}()
+
+	d := &Client{clientConn: client, CaptureStderr: true}
+	if err := d.startRPC(true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestUpgradeCodec(t *testing.T) {
+	d := newUpgradableClient(t)
+
+	var reply string
+	if err := d.Call("Echo.Echo", "json", &reply); err != nil || reply != "json" {
+		t.Fatalf("Call before the upgrade = %q, %v", reply, err)
+	}
+	if err := d.UpgradeCodec(context.Background(), newGobClientCodec); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Call("Echo.Echo", "gob", &reply); err != nil || reply != "gob" {
+		t.Fatalf("Call after the upgrade = %q, %v", reply, err)
+	}
+	if _, err := d.CallStream(context.Background(), "Echo.Count", 1); err != errNeedsCodec {
+		t.Errorf("CallStream after the upgrade = %v, want %v", err, errNeedsCodec)
+	}
+	if err := d.UpgradeCodec(context.Background(), newGobClientCodec); err == nil {
+		t.Error("second UpgradeCodec succeeded")
+	}
+}
+
+func TestUpgradeCodecWaitsForCalls(t *testing.T) {
+	d := newUpgradableClient(t)
+
+	slow := make(chan error, 1)
+	go func() {
+		var reply time.Duration
+		slow <- d.Call("Echo.Sleep", 100*time.Millisecond, &reply)
+	}()
+	for d.codec.idle() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := d.UpgradeCodec(context.Background(), newGobClientCodec); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("call in flight during the upgrade failed: %v", err)
+	}
+}
+
+func TestCloseDuringUpgradeCodec(t *testing.T) {
+	d := newUpgradableClient(t)
+
+	go func() {
+		var reply time.Duration
+		d.Call("Echo.Sleep", 10*time.Second, &reply)
+	}()
+	for d.codec.idle() {
+		time.Sleep(time.Millisecond)
+	}
+
+	upgraded := make(chan error, 1)
+	go func() {
+		upgraded <- d.UpgradeCodec(context.Background(), newGobClientCodec)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- d.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on UpgradeCodec")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case err := <-upgraded:
+		if err == nil {
+			t.Error("UpgradeCodec succeeded on a closed client")
+		}
+	case <-ctx.Done():
+		t.Fatal("UpgradeCodec did not return after Close")
+	}
+}
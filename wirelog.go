@@ -0,0 +1,86 @@
+package dockerpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//
+// SetWireLog makes the Client record every JSON-RPC message it exchanges
+// with the plugin to `w`, for debugging protocol issues. Each record is a
+// header line with the direction (">" for requests sent, "<" for responses
+// received), a UTC RFC 3339 timestamp and the message length, followed by
+// the message bytes and a newline:
+//
+//	> 2015-10-12T12:09:23.123456Z 49
+//	{"method":"Plugin.SayHi","params":["jen"],"id":1}
+//
+// The length prefix makes the log parseable and replayable. Nothing is
+// recorded after UpgradeCodec, nor with a codec from NewConnClient's
+// factory. It must be set before Start.
+//
+func (d *Client) SetWireLog(w io.Writer) {
+	d.wireLog = w
+}
+
+// wireLog writes records for the messages crossing a wireConn.
+type wireLog struct {
+	mutex sync.Mutex // serializes records
+	w     io.Writer
+}
+
+func (l *wireLog) record(direction byte, msg []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintf(l.w, "%c %s %d\n", direction, time.Now().UTC().Format(time.RFC3339Nano), len(msg))
+	l.w.Write(msg)
+	l.w.Write([]byte{'\n'})
+}
+
+//
+// wireConn sits between the codec and the plugin connection, and records
+// each newline terminated JSON message read or written.
+//
+type wireConn struct {
+	io.ReadWriteCloser
+	log *wireLog
+	in  bytes.Buffer // partial response; only touched by the codec's reader
+	out bytes.Buffer // partial request; writes are serialized by the codec
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	c.in.Write(b[:n])
+	c.emit('<', &c.in)
+	return n, err
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	c.out.Write(b[:n])
+	c.emit('>', &c.out)
+	return n, err
+}
+
+// Flush flushes the connection under the wire log.
+func (c *wireConn) Flush() error {
+	if f, ok := c.ReadWriteCloser.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// emit records every complete message in `buf`.
+func (c *wireConn) emit(direction byte, buf *bytes.Buffer) {
+	for {
+		i := bytes.IndexByte(buf.Bytes(), '\n')
+		if i < 0 {
+			return
+		}
+		line := buf.Next(i + 1)
+		c.log.record(direction, line[:i])
+	}
+}
@@ -0,0 +1,71 @@
+package dockerpc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+type wireRecord struct {
+	direction byte
+	msg       string
+}
+
+// readWireLog parses the records of a wire log.
+func readWireLog(t *testing.T, log []byte) []wireRecord {
+	var records []wireRecord
+	r := bufio.NewReader(bytes.NewReader(log))
+	for {
+		header, err := r.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("truncated record header %q", header)
+		}
+		var direction byte
+		var stamp string
+		var size int
+		if _, err := fmt.Sscanf(header, "%c %s %d\n", &direction, &stamp, &size); err != nil {
+			t.Fatalf("bad record header %q: %v", header, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, stamp); err != nil {
+			t.Errorf("bad timestamp in %q: %v", header, err)
+		}
+		msg := make([]byte, size+1)
+		if _, err := io.ReadFull(r, msg); err != nil || msg[size] != '\n' {
+			t.Fatalf("record %q is not %d bytes and a newline", msg, size)
+		}
+		records = append(records, wireRecord{direction, string(msg[:size])})
+	}
+}
+
+func TestWireLog(t *testing.T) {
+	var log bytes.Buffer
+	d := newTestClient(t, func(d *Client) {
+		d.SetWireLog(&log)
+	})
+
+	var reply string
+	if err := d.Call("Echo.Echo", "hi", &reply); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	want := []wireRecord{
+		{'>', `{"method":"Echo.Echo","params":["hi"],"id":1}`},
+		{'<', `{"id":1,"result":"hi","error":null}`},
+	}
+	got := readWireLog(t, log.Bytes())
+	if len(got) != len(want) {
+		t.Fatalf("got records %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}